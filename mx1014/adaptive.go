@@ -0,0 +1,130 @@
+package mx1014
+
+import (
+    "sync"
+)
+
+// AdaptiveLimiter is the adaptive concurrency (-adapt) of the TCP connects, like
+// the congestion control of TCP: the timeouts mean the path or a firewall is
+// overloaded, when their ratio in the sliding window exceeds the threshold the
+// concurrency is halved, otherwise it grows additively up to -t. Every host is
+// counted until it is discarded (-a), a host that has not answered yet may be
+// up and dropped by the overloaded path; the timeouts of the discarded hosts
+// are expected and not counted
+type AdaptiveLimiter struct {
+    mutex     sync.Mutex
+    cond      *sync.Cond
+    limit     int
+    minLimit  int
+    maxLimit  int
+    step      int
+    inflight  int
+    threshold float64
+    window    []bool // the last samples, true: timeout
+    next      int
+    filled    int
+    timeouts  int
+    fresh     int // samples since the last adjustment
+    lowest    int
+}
+
+const (
+    adaptiveWindow   = 200
+    adaptiveInterval = 50
+)
+
+// adaptiveLimiter is nil unless -adapt is set
+var adaptiveLimiter *AdaptiveLimiter
+
+func NewAdaptiveLimiter(maxLimit int, threshold float64) *AdaptiveLimiter {
+    a := &AdaptiveLimiter{
+        limit:     maxLimit,
+        minLimit:  8,
+        maxLimit:  maxLimit,
+        step:      maxLimit / 32,
+        threshold: threshold,
+        window:    make([]bool, adaptiveWindow),
+        lowest:    maxLimit,
+    }
+    if a.minLimit > maxLimit {
+        a.minLimit = maxLimit
+    }
+    if a.step < 1 {
+        a.step = 1
+    }
+    a.cond = sync.NewCond(&a.mutex)
+    return a
+}
+
+// Acquire waits for a slot of the current concurrency
+func (a *AdaptiveLimiter) Acquire() {
+    a.mutex.Lock()
+    for a.inflight >= a.limit {
+        a.cond.Wait()
+    }
+    a.inflight++
+    a.mutex.Unlock()
+}
+
+// Release frees the slot and records the result of the connect (see TcpConnect)
+// when the host was not discarded before the probe
+func (a *AdaptiveLimiter) Release(flag PortState, counted bool) {
+    a.mutex.Lock()
+    a.inflight--
+    if counted && (flag == StateOpen || flag == StateClosed || flag == StateFiltered) {
+        a.observe(flag == StateFiltered)
+    }
+    a.mutex.Unlock()
+    a.cond.Broadcast()
+}
+
+func (a *AdaptiveLimiter) observe(timeout bool) {
+    if a.filled == len(a.window) {
+        if a.window[a.next] {
+            a.timeouts--
+        }
+    } else {
+        a.filled++
+    }
+    a.window[a.next] = timeout
+    if timeout {
+        a.timeouts++
+    }
+    a.next = (a.next + 1) % len(a.window)
+
+    a.fresh++
+    if a.fresh < adaptiveInterval {
+        return
+    }
+    a.fresh = 0
+    if float64(a.timeouts)/float64(a.filled) > a.threshold {
+        // multiplicative decrease, and forget the samples of the old concurrency
+        a.limit /= 2
+        if a.limit < a.minLimit {
+            a.limit = a.minLimit
+        }
+        if a.limit < a.lowest {
+            a.lowest = a.limit
+        }
+        a.filled, a.next, a.timeouts = 0, 0, 0
+    } else if a.limit < a.maxLimit {
+        a.limit += a.step
+        if a.limit > a.maxLimit {
+            a.limit = a.maxLimit
+        }
+    }
+}
+
+// Limit returns the current effective concurrency
+func (a *AdaptiveLimiter) Limit() int {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+    return a.limit
+}
+
+// Lowest returns the lowest concurrency of the run
+func (a *AdaptiveLimiter) Lowest() int {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+    return a.lowest
+}
@@ -0,0 +1,131 @@
+package mx1014
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// ownPorts returns the ports of the group that are not in its child groups
+func ownPorts(name string) []int {
+    inChild := make(map[int]bool)
+    for _, child := range portGroupChildren[name] {
+        for _, port := range portGroup[child] {
+            inChild[port] = true
+        }
+    }
+    var ports []int
+    for _, port := range portGroup[name] {
+        if !inChild[port] {
+            ports = append(ports, port)
+        }
+    }
+    return ports
+}
+
+func joinPorts(ports []int) string {
+    items := make([]string, len(ports))
+    for i, port := range ports {
+        items[i] = strconv.Itoa(port)
+    }
+    return strings.Join(items, ",")
+}
+
+// rootGroups returns the groups that no other group references
+func rootGroups() []string {
+    referenced := make(map[string]bool)
+    for _, children := range portGroupChildren {
+        for _, child := range children {
+            referenced[child] = true
+        }
+    }
+    var roots []string
+    for name := range portGroup {
+        if !referenced[name] {
+            roots = append(roots, name)
+        }
+    }
+    sort.Strings(roots)
+    return roots
+}
+
+func printGroupNode(name string, prefix string, last bool, depth int) {
+    branch, childPrefix := "", ""
+    if depth > 0 {
+        branch, childPrefix = "|-- ", prefix+"|   "
+        if last {
+            branch, childPrefix = "`-- ", prefix+"    "
+        }
+    }
+    line := fmt.Sprintf("%s%s%s (%d)", prefix, branch, name, len(portGroup[name]))
+    if ports := ownPorts(name); len(ports) > 0 {
+        line += ": " + joinPorts(ports)
+    }
+    fmt.Println(line)
+    children := portGroupChildren[name]
+    for i, child := range children {
+        printGroupNode(child, childPrefix, i == len(children)-1, depth+1)
+    }
+}
+
+// PrintPortGroupTree prints the port group and its child groups, "all" for all top groups
+func PrintPortGroupTree(name string) {
+    names := strings.Split(name, ",")
+    if name == "all" {
+        names = rootGroups()
+    }
+    for _, name := range names {
+        if portGroup[name] == nil {
+            ErrPrint(fmt.Sprintf("Unknown port group: %s", name))
+        }
+    }
+    for _, name := range names {
+        printGroupNode(name, "", true, 0)
+    }
+}
+
+// PrintPortGroups lists all port groups with their port counts
+func PrintPortGroups() {
+    var names []string
+    for name := range portGroup {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    fmt.Printf("# Count: %d\n", len(names))
+    for _, name := range names {
+        fmt.Printf("%-16s %d\n", name, len(portGroup[name]))
+    }
+}
+
+// PrintPortLookup prints every port group that contains each of the ports
+func PrintPortLookup(portList string) {
+    ports, err := ParsePortExpr(portList)
+    if err != nil {
+        ErrPrint(fmt.Sprintf("Wrong port expression: %s", err))
+    }
+    for _, port := range ports {
+        groups := append([]string{}, portGroupMap[port]...)
+        sort.Strings(groups)
+        if len(groups) == 0 {
+            fmt.Printf("%-6d -\n", port)
+            continue
+        }
+        fmt.Printf("%-6d %s (all: %s)\n", port, strings.Join(specificGroups(groups), ","), strings.Join(groups, ","))
+    }
+}
+
+// PrintPortGroupSearch prints the port groups whose names contain the keyword
+func PrintPortGroupSearch(keyword string) {
+    var names []string
+    for name := range portGroup {
+        if strings.Contains(strings.ToLower(name), strings.ToLower(keyword)) {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    fmt.Printf("# Count: %d\n", len(names))
+    for _, name := range names {
+        fmt.Printf("%-16s (%d) %s\n", name, len(portGroup[name]), joinPorts(portGroup[name]))
+    }
+}
@@ -0,0 +1,168 @@
+package mx1014
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// TaskSpace maps a flat index onto the (host, port) pairs of the scan
+type TaskSpace struct {
+    segments []taskSegment
+    size     uint64
+}
+
+type taskSegment struct {
+    port   string
+    hosts  HostSet
+    offset uint64
+}
+
+func (t *TaskSpace) Add(port string, hosts HostSet) {
+    if hosts.Len() == 0 {
+        return
+    }
+    t.segments = append(t.segments, taskSegment{port: port, hosts: hosts, offset: t.size})
+    t.size += uint64(hosts.Len())
+}
+
+func (t *TaskSpace) Size() uint64 {
+    return t.size
+}
+
+// ShardSize is the number of tasks j of the current shard, j % shardCount == shardIndex
+func (t *TaskSpace) ShardSize() uint64 {
+    if shardIndex >= t.size {
+        return 0
+    }
+    return (t.size - shardIndex + shardCount - 1) / shardCount
+}
+
+// ShardTask returns the k-th task of the current shard
+func (t *TaskSpace) ShardTask(k uint64) (string, string) {
+    return t.Task(shardIndex + k*shardCount)
+}
+
+func (t *TaskSpace) Task(i uint64) (string, string) {
+    n := sort.Search(len(t.segments), func(j int) bool {
+        return t.segments[j].offset > i
+    }) - 1
+    segment := t.segments[n]
+    return segment.hosts.Host(int(i - segment.offset)), segment.port
+}
+
+// Permutation is a seeded bijection of [0, size), a small feistel network with
+// cycle walking (like masscan's blackrock), so that the probes spread evenly over
+// the hosts and the same seed always gives the same order
+type Permutation struct {
+    size     uint64
+    halfBits uint
+    halfMask uint64
+    keys     [4]uint64
+}
+
+func NewPermutation(size uint64, seed int64) *Permutation {
+    p := &Permutation{size: size, halfBits: 1}
+    for uint64(1)<<(2*p.halfBits) < size {
+        p.halfBits++
+    }
+    p.halfMask = uint64(1)<<p.halfBits - 1
+    state := uint64(seed)
+    for i := range p.keys {
+        state = splitmix64(state)
+        p.keys[i] = state
+    }
+    return p
+}
+
+func splitmix64(x uint64) uint64 {
+    x += 0x9e3779b97f4a7c15
+    x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+    x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+    return x ^ (x >> 31)
+}
+
+func (p *Permutation) encrypt(x uint64) uint64 {
+    left, right := x>>p.halfBits, x&p.halfMask
+    for _, key := range p.keys {
+        left, right = right, left^(splitmix64(right^key)&p.halfMask)
+    }
+    return left<<p.halfBits | right
+}
+
+// Shuffle returns the position of i in the permuted order
+func (p *Permutation) Shuffle(i uint64) uint64 {
+    x := p.encrypt(i)
+    for x >= p.size {
+        x = p.encrypt(x)
+    }
+    return x
+}
+
+// sortPorts sorts the port strings numerically, the map order of portMap is random
+func sortPorts(ports []string) {
+    sort.Slice(ports, func(i, j int) bool {
+        a, _ := strconv.Atoi(ports[i])
+        b, _ := strconv.Atoi(ports[j])
+        return a < b
+    })
+}
+
+// BuildTaskSpaces returns the task spaces in the dispatch order: the priority
+// ports (-hp), the tiers of the ranked ports (see rankTiers), then the rest
+func BuildTaskSpaces() []*TaskSpace {
+    headPorts := make(map[string]bool)
+    if headPortRanges != "" {
+        headPorts = GetObjectMap(ParsePortRange(headPortRanges, true))
+    }
+    tiers := portRankTiers()
+
+    var ports []string
+    for port := range portMap {
+        ports = append(ports, port)
+    }
+    sortPorts(ports)
+
+    // head, tier 0, tier 1, ..., rest
+    spaces := make([]*TaskSpace, len(rankTiers)+2)
+    for i := range spaces {
+        spaces[i] = &TaskSpace{}
+    }
+    for _, port := range ports {
+        space := spaces[len(spaces)-1]
+        portNum, _ := strconv.Atoi(port)
+        if headPorts[port] {
+            space = spaces[0]
+        } else if tier, ok := tiers[portNum]; ok {
+            space = spaces[tier+1]
+        }
+        rawTargets := append([]string{}, portMap[port]...)
+        sort.Strings(rawTargets)
+        for _, rawTarget := range rawTargets {
+            space.Add(port, hostMap[rawTarget])
+        }
+    }
+    return spaces
+}
+
+// ParseShard parses "i/n" (1 <= i <= n), the shards split the task space without
+// depending on the seed, so n instances with the same arguments cover it exactly once
+func ParseShard(shard string) (uint64, uint64, error) {
+    items := strings.Split(shard, "/")
+    if len(items) != 2 {
+        return 0, 0, fmt.Errorf("wrong shard: %s", shard)
+    }
+    i, err := strconv.ParseUint(items[0], 10, 64)
+    if err != nil {
+        return 0, 0, fmt.Errorf("wrong shard index: %s", items[0])
+    }
+    n, err := strconv.ParseUint(items[1], 10, 64)
+    if err != nil || n == 0 {
+        return 0, 0, fmt.Errorf("wrong shard count: %s", items[1])
+    }
+    if i < 1 || i > n {
+        return 0, 0, fmt.Errorf("shard index out of range (1-%d): %d", n, i)
+    }
+    return i - 1, n, nil
+}
@@ -0,0 +1,119 @@
+package mx1014
+
+import (
+    "testing"
+)
+
+func TestPermutationBijection(t *testing.T) {
+    sizes := []uint64{1, 2, 3, 7, 16, 17, 100, 1000, 4097, 65535}
+    seeds := []int64{0, 1, -1, 1014, 1792415149059883249}
+    for _, size := range sizes {
+        for _, seed := range seeds {
+            perm := NewPermutation(size, seed)
+            seen := make([]bool, size)
+            for i := uint64(0); i < size; i++ {
+                x := perm.Shuffle(i)
+                if x >= size {
+                    t.Fatalf("size %d seed %d: Shuffle(%d) = %d out of range", size, seed, i, x)
+                }
+                if seen[x] {
+                    t.Fatalf("size %d seed %d: Shuffle(%d) = %d is repeated", size, seed, i, x)
+                }
+                seen[x] = true
+            }
+        }
+    }
+}
+
+func TestPermutationSeed(t *testing.T) {
+    a, b, c := NewPermutation(1000, 7), NewPermutation(1000, 7), NewPermutation(1000, 8)
+    same, differ := true, false
+    for i := uint64(0); i < 1000; i++ {
+        if a.Shuffle(i) != b.Shuffle(i) {
+            same = false
+        }
+        if a.Shuffle(i) != c.Shuffle(i) {
+            differ = true
+        }
+    }
+    if !same {
+        t.Error("the same seed gives different orders")
+    }
+    if !differ {
+        t.Error("different seeds give the same order")
+    }
+}
+
+func testTaskSpace() *TaskSpace {
+    space := &TaskSpace{}
+    space.Add("22", &ipRange{start: 0x0a000001, size: 3})
+    space.Add("80", &ipRange{start: 0x0a000001, size: 250})
+    space.Add("443", hostName("example.com"))
+    space.Add("8080", &ipRange{start: 0xc0a80001, size: 0})
+    return space
+}
+
+func TestShardsCoverTaskSpace(t *testing.T) {
+    defer func(index, count uint64) {
+        shardIndex, shardCount = index, count
+    }(shardIndex, shardCount)
+
+    space := testTaskSpace()
+    all := make(map[string]bool)
+    shardIndex, shardCount = 0, 1
+    for k := uint64(0); k < space.ShardSize(); k++ {
+        host, port := space.ShardTask(k)
+        all[host+":"+port] = true
+    }
+    if uint64(len(all)) != space.Size() || space.Size() != 254 {
+        t.Fatalf("task space has %d distinct tasks, size %d, expect 254", len(all), space.Size())
+    }
+
+    for _, count := range []uint64{1, 2, 3, 7, 254, 300} {
+        seen := make(map[string]uint64)
+        for index := uint64(0); index < count; index++ {
+            shardIndex, shardCount = index, count
+            perm := NewPermutation(space.ShardSize(), int64(index))
+            for k := uint64(0); k < space.ShardSize(); k++ {
+                host, port := space.ShardTask(perm.Shuffle(k))
+                task := host + ":" + port
+                if previous, ok := seen[task]; ok {
+                    t.Fatalf("%d shards: %s is in shard %d and %d", count, task, previous+1, index+1)
+                }
+                seen[task] = index
+            }
+        }
+        if len(seen) != len(all) {
+            t.Fatalf("%d shards cover %d tasks, expect %d", count, len(seen), len(all))
+        }
+    }
+}
+
+func TestParseShard(t *testing.T) {
+    tests := []struct {
+        shard string
+        index uint64
+        count uint64
+        ok    bool
+    }{
+        {"1/1", 0, 1, true},
+        {"2/3", 1, 3, true},
+        {"3/3", 2, 3, true},
+        {"0/3", 0, 0, false},
+        {"4/3", 0, 0, false},
+        {"1/0", 0, 0, false},
+        {"1", 0, 0, false},
+        {"a/3", 0, 0, false},
+        {"1/2/3", 0, 0, false},
+    }
+    for _, test := range tests {
+        index, count, err := ParseShard(test.shard)
+        if (err == nil) != test.ok {
+            t.Errorf("ParseShard(%q) error = %v, expect ok %t", test.shard, err, test.ok)
+            continue
+        }
+        if test.ok && (index != test.index || count != test.count) {
+            t.Errorf("ParseShard(%q) = %d, %d, expect %d, %d", test.shard, index, count, test.index, test.count)
+        }
+    }
+}
@@ -0,0 +1,387 @@
+package mx1014
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// DNS egress test (-dns), the queries are uniquely labeled
+//   <run id>-<path>.<port>.<test domain>
+// path is "sys" (the system resolver), "udp-8-8-8-8" or "tcp-8-8-8-8" (direct
+// to a server), the MX1014 listener (-L 53 -dns) is the authoritative server of
+// the test domain, it records the queries and answers them with dnsMarker
+
+var dnsMarker = net.IPv4(127, 0, 10, 14)
+
+var errDNSFormat = errors.New("wrong DNS message")
+
+// checkDNSName: labels of 1..63 bytes, at most 253 bytes in text form (RFC 1035)
+func checkDNSName(name string) error {
+    name = strings.TrimSuffix(name, ".")
+    if len(name) > 253 {
+        return fmt.Errorf("DNS name is %d bytes, longer than 253: %s", len(name), name)
+    }
+    for _, label := range strings.Split(name, ".") {
+        if len(label) == 0 || len(label) > 63 {
+            return fmt.Errorf("DNS label is %d bytes, must be 1..63: %q in %s", len(label), label, name)
+        }
+    }
+    return nil
+}
+
+func buildDNSQuery(id uint16, name string) ([]byte, error) {
+    if err := checkDNSName(name); err != nil {
+        return nil, err
+    }
+    msg := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0} // RD, 1 question
+    for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+        msg = append(msg, byte(len(label)))
+        msg = append(msg, label...)
+    }
+    return append(msg, 0, 0, 1, 0, 1), nil // QTYPE A, QCLASS IN
+}
+
+// parseDNSName reads the (compressed) name at off, returns the name and the offset after it
+func parseDNSName(msg []byte, off int) (string, int, error) {
+    var labels []string
+    end := -1
+    for jumps := 0; jumps < 16; {
+        if off >= len(msg) {
+            return "", 0, errDNSFormat
+        }
+        length := int(msg[off])
+        switch {
+        case length == 0:
+            if end < 0 {
+                end = off + 1
+            }
+            return strings.Join(labels, "."), end, nil
+        case length&0xc0 == 0xc0: // pointer
+            if off+1 >= len(msg) {
+                return "", 0, errDNSFormat
+            }
+            if end < 0 {
+                end = off + 2
+            }
+            off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+            jumps++
+        default:
+            if off+1+length > len(msg) {
+                return "", 0, errDNSFormat
+            }
+            labels = append(labels, string(msg[off+1:off+1+length]))
+            off += 1 + length
+        }
+    }
+    return "", 0, errDNSFormat
+}
+
+// parseDNSAnswers returns the A records of the response to the query id
+func parseDNSAnswers(id uint16, msg []byte) ([]net.IP, error) {
+    if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+        return nil, errDNSFormat
+    }
+    qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+    anCount := int(binary.BigEndian.Uint16(msg[6:]))
+    off := 12
+    for i := 0; i < qdCount; i++ {
+        _, next, err := parseDNSName(msg, off)
+        if err != nil {
+            return nil, err
+        }
+        off = next + 4
+    }
+    var ips []net.IP
+    for i := 0; i < anCount; i++ {
+        _, next, err := parseDNSName(msg, off)
+        if err != nil || next+10 > len(msg) {
+            return nil, errDNSFormat
+        }
+        rrType := binary.BigEndian.Uint16(msg[next:])
+        rdLength := int(binary.BigEndian.Uint16(msg[next+8:]))
+        off = next + 10 + rdLength
+        if off > len(msg) {
+            return nil, errDNSFormat
+        }
+        if rrType == 1 && rdLength == 4 {
+            ips = append(ips, net.IP(msg[next+10:off]))
+        }
+    }
+    return ips, nil
+}
+
+func hasDNSMarker(ips []net.IP) bool {
+    for _, ip := range ips {
+        if ip.Equal(dnsMarker) {
+            return true
+        }
+    }
+    return false
+}
+
+// dnsExchange sends the query to the server over udp or tcp, returns the A records
+func dnsExchange(network string, server string, name string) ([]net.IP, error) {
+    id := uint16(time.Now().UnixNano())
+    query, err := buildDNSQuery(id, name)
+    if err != nil {
+        return nil, err
+    }
+    conn, err := net.DialTimeout(network, server, time.Millisecond*time.Duration(timeout))
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout) * 2))
+
+    if network == "tcp" {
+        query = append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+    }
+    if _, err := conn.Write(query); err != nil {
+        return nil, err
+    }
+    var msg []byte
+    if network == "tcp" {
+        length := make([]byte, 2)
+        if _, err := io.ReadFull(conn, length); err != nil {
+            return nil, err
+        }
+        msg = make([]byte, binary.BigEndian.Uint16(length))
+        if _, err := io.ReadFull(conn, msg); err != nil {
+            return nil, err
+        }
+    } else {
+        buf := make([]byte, 4096)
+        n, err := conn.Read(buf)
+        if err != nil {
+            return nil, err
+        }
+        msg = buf[:n]
+    }
+    return parseDNSAnswers(id, msg)
+}
+
+// dnsTestName: <run id>-<path>.<port>.<domain>
+func dnsTestName(path string, port string, domain string) string {
+    return egressRunID + "-" + strings.NewReplacer(".", "-", ":", "-").Replace(path) + "." + port + "." + strings.Trim(domain, ".")
+}
+
+func dnsResult(ips []net.IP, err error) string {
+    if err != nil {
+        return "no"
+    } else if hasDNSMarker(ips) {
+        return "yes"
+    }
+    return "answered" // by someone else, e.g. a hijacking resolver
+}
+
+// systemNameservers returns the nameservers of /etc/resolv.conf
+func systemNameservers() []string {
+    var servers []string
+    for _, line := range readLines("/etc/resolv.conf") {
+        fields := strings.Fields(line)
+        if len(fields) >= 2 && fields[0] == "nameserver" {
+            servers = append(servers, fields[1])
+        }
+    }
+    return servers
+}
+
+// CheckDNSDomain checks the test names of the domain before the run
+func CheckDNSDomain(domain string) error {
+    return checkDNSName(dnsTestName("sys", "53", domain))
+}
+
+// DNSEgress sends the labeled queries through the system resolver and directly
+// to the servers (ip[:port], the nameservers of resolv.conf if empty) on udp and
+// tcp, the result goes to the outbound summary
+func DNSEgress(domain string, serverList string) {
+    var servers []string
+    if serverList != "" {
+        servers = strings.Split(serverList, ",")
+    } else {
+        servers = systemNameservers()
+    }
+    log.Printf("\n# %s DNS egress test: %s (run id: %s)\n\n", time.Now().Format("2006/01/02 15:04:05"), domain, egressRunID)
+
+    yes := 0
+    name := dnsTestName("sys", "53", domain)
+    var ips []net.IP
+    addrs, err := net.LookupHost(name)
+    if err != nil {
+        log.Printf("# system resolver: %s\n", err)
+    }
+    for _, addr := range addrs {
+        ips = append(ips, net.ParseIP(addr))
+    }
+    result := dnsResult(ips, err)
+    if result == "yes" {
+        yes++
+    }
+    log.Printf("%-26s %-8s %s\n", "system resolver", result, name)
+
+    for _, server := range servers {
+        server = strings.TrimSpace(server)
+        host, port, err := net.SplitHostPort(server)
+        if err != nil {
+            host, port = server, "53"
+        }
+        if serverList != "" && !CheckEgressScope(host, "-ds") {
+            continue
+        }
+        for _, network := range []string{"udp", "tcp"} {
+            name := dnsTestName(network+"-"+host, port, domain)
+            ips, err := dnsExchange(network, net.JoinHostPort(host, port), name)
+            if err != nil {
+                log.Printf("# %s/%s: %s\n", net.JoinHostPort(host, port), network, err)
+            }
+            result := dnsResult(ips, err)
+            if result == "yes" {
+                yes++
+            }
+            log.Printf("%-26s %-8s %s\n", net.JoinHostPort(host, port)+"/"+network, result, name)
+        }
+    }
+    paths := len(servers)*2 + 1
+    log.Printf("\n# DNS egress: %d/%d paths reached the listener\n", yes, paths)
+    outbound = append(outbound, fmt.Sprintf("DNS %d/%d %s", yes, paths, yesNo(yes > 0)))
+}
+
+// dnsQuery is a query that arrived at the listener
+type dnsQuery struct {
+    path      string // sys, udp-8-8-8-8 ...
+    port      string
+    transport string // the transport that reached the listener
+    resolver  string // the source, the recursive resolver or the client itself
+}
+
+// answerDNS answers the query of the test domain with dnsMarker, returns the
+// response and the query name
+func answerDNS(msg []byte) ([]byte, string, error) {
+    if len(msg) < 12 || msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:]) == 0 {
+        return nil, "", errDNSFormat
+    }
+    name, next, err := parseDNSName(msg, 12)
+    if err != nil || next+4 > len(msg) {
+        return nil, "", errDNSFormat
+    }
+    name = strings.ToLower(name) // 0x20 randomization of the resolvers
+    qType := binary.BigEndian.Uint16(msg[next:])
+    domain := strings.ToLower(strings.Trim(dnsDomain, "."))
+
+    response := make([]byte, next+4, next+20)
+    copy(response, msg[:next+4])
+    response[2] = 0x84 | msg[2]&0x01 // QR, AA, RD
+    response[3] = 0
+    binary.BigEndian.PutUint16(response[4:], 1)
+    binary.BigEndian.PutUint16(response[6:], 0)
+    binary.BigEndian.PutUint16(response[8:], 0)
+    binary.BigEndian.PutUint16(response[10:], 0)
+    if name != domain && !strings.HasSuffix(name, "."+domain) {
+        response[3] = 5 // REFUSED
+    } else if qType == 1 {
+        binary.BigEndian.PutUint16(response[6:], 1)
+        response = append(response, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4) // A, IN, TTL 0
+        response = append(response, dnsMarker.To4()...)
+    }
+    return response, name, nil
+}
+
+// recordDNS records the query if it has the label of the test
+func (l *EgressListener) recordDNS(transport string, source string, name string) {
+    labels := strings.SplitN(name, ".", 3)
+    if len(labels) < 3 || !strings.Contains(labels[0], "-") {
+        log.Printf("# dns %s %-21s => %s\n", transport, source, name)
+        return
+    }
+    token := strings.SplitN(labels[0], "-", 2)
+    q := dnsQuery{path: token[1], port: labels[1], transport: transport, resolver: addrHost(source)}
+
+    l.mutex.Lock()
+    l.dnsQueries = append(l.dnsQueries, q)
+    log.Printf("# dns %s %-21s => %s (%s)\n", transport, source, name, q.path)
+    l.mutex.Unlock()
+}
+
+func (l *EgressListener) serveDNSUDP(conn net.PacketConn) {
+    buf := make([]byte, 4096)
+    for {
+        n, addr, err := conn.ReadFrom(buf)
+        if err != nil {
+            continue
+        }
+        response, name, err := answerDNS(buf[:n])
+        if err != nil {
+            if verbose {
+                log.Printf("# Error: %s %s\n", addr, err)
+            }
+            continue
+        }
+        conn.WriteTo(response, addr)
+        l.recordDNS("udp", addr.String(), name)
+    }
+}
+
+func (l *EgressListener) serveDNSTCP(listener net.Listener) {
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            continue
+        }
+        go func(conn net.Conn) {
+            defer conn.Close()
+            conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout)))
+            length := make([]byte, 2)
+            if _, err := io.ReadFull(conn, length); err != nil {
+                return
+            }
+            msg := make([]byte, binary.BigEndian.Uint16(length))
+            if _, err := io.ReadFull(conn, msg); err != nil {
+                return
+            }
+            response, name, err := answerDNS(msg)
+            if err != nil {
+                return
+            }
+            conn.Write(append([]byte{byte(len(response) >> 8), byte(len(response))}, response...))
+            l.recordDNS("tcp", conn.RemoteAddr().String(), name)
+        }(conn)
+    }
+}
+
+// DNSReport prints which paths of the DNS egress test arrived and by which resolvers
+func (l *EgressListener) DNSReport() {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    paths := make(map[string]map[string]bool) // path: resolver/transport
+    for _, q := range l.dnsQueries {
+        key := q.path + " " + q.port
+        if paths[key] == nil {
+            paths[key] = make(map[string]bool)
+        }
+        paths[key][q.resolver+"/"+q.transport] = true
+    }
+    var keys []string
+    for key := range paths {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    log.Printf("\n# DNS egress report (%d queries, %d paths)\n", len(l.dnsQueries), len(keys))
+    for _, key := range keys {
+        fields := strings.Fields(key)
+        log.Printf("%-26s %-5s <= %s\n", fields[0], fields[1], sortedKeys(paths[key]))
+    }
+}
+
+// isDNSPort: the port of -L that is served as DNS (-dns)
+func isDNSPort(port string) bool {
+    n, _ := strconv.Atoi(port)
+    return dnsDomain != "" && n == 53
+}
@@ -0,0 +1,286 @@
+package mx1014
+
+import (
+    "bytes"
+    "log"
+    "net"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// ICMP echo (-icmp) and IPv6 (-6) egress tests, the firewalls often forget them.
+// The echo requests carry the token "MX1014-ICMP <run id> <mac>" (the mac is
+// "-" without -k), the listener (-L -icmp) checks it, the kernel replies
+
+// outbound is the summary of the ICMP and IPv6 egress tests, e.g. ICMP yes
+var outbound []string
+
+func yesNo(ok bool) string {
+    if ok {
+        return "yes"
+    }
+    return "no"
+}
+
+func icmpToken() []byte {
+    mac := "-"
+    if egressKey != "" {
+        mac = egressMAC("icmp", egressRunID, "0")
+    }
+    return []byte("MX1014-ICMP " + egressRunID + " " + mac)
+}
+
+// checkICMPToken returns "verified" (the key matches), "token" (no -k) or "" (not a token)
+func checkICMPToken(payload []byte) string {
+    fields := strings.Fields(string(payload))
+    if len(fields) != 3 || fields[0] != "MX1014-ICMP" {
+        return ""
+    }
+    if egressKey == "" {
+        return "token"
+    }
+    if fields[2] == egressMAC("icmp", fields[1], "0") {
+        return "verified"
+    }
+    return ""
+}
+
+func icmpChecksum(msg []byte) uint16 {
+    var sum uint32
+    for i := 0; i+1 < len(msg); i += 2 {
+        sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+    }
+    if len(msg)%2 == 1 {
+        sum += uint32(msg[len(msg)-1]) << 8
+    }
+    for sum>>16 != 0 {
+        sum = sum>>16 + sum&0xffff
+    }
+    return ^uint16(sum)
+}
+
+func icmpRequest(id int, seq int, payload []byte) []byte {
+    msg := []byte{8, 0, 0, 0, byte(id >> 8), byte(id), byte(seq >> 8), byte(seq)}
+    msg = append(msg, payload...)
+    checksum := icmpChecksum(msg)
+    msg[2], msg[3] = byte(checksum>>8), byte(checksum)
+    return msg
+}
+
+// icmpTask is a host of the ICMP egress test, by its index in the HostSet
+type icmpTask struct {
+    hosts HostSet
+    i     int
+}
+
+// ICMPEgress pings every target host once with the token, the requests are
+// sent by -t goroutines over the HostSets (no copy of the hosts) and the replies
+// are matched by one reader. The hosts that replied are printed, the others with -v
+func ICMPEgress() {
+    conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+    if err != nil {
+        log.Printf("# ICMP egress test failed: %s (needs root)\n", err)
+        outbound = append(outbound, "ICMP unknown")
+        return
+    }
+    defer conn.Close()
+    id := os.Getpid() & 0xffff
+    payload := icmpToken()
+
+    // the reply echoes our id and token, its source is a pinged host
+    var lock sync.Mutex
+    replied := make(map[string]bool) // ip
+    readerDone := make(chan struct{})
+    go func() {
+        defer close(readerDone)
+        buf := make([]byte, 1500)
+        for {
+            n, addr, err := conn.ReadFrom(buf)
+            if err != nil {
+                return // the deadline after the last request
+            }
+            reply := buf[:n]
+            if n < 8 || reply[0] != 0 || int(reply[4])<<8|int(reply[5]) != id || !bytes.Equal(reply[8:], payload) {
+                continue
+            }
+            lock.Lock()
+            replied[addr.(*net.IPAddr).IP.String()] = true
+            lock.Unlock()
+        }
+    }()
+
+    hostIP := func(task icmpTask) string {
+        if ipSet, ok := task.hosts.(IPSet); ok {
+            return Uint32ToIP(ipSet.Addr(task.i))
+        }
+        if dst, err := net.ResolveIPAddr("ip4", task.hosts.Host(task.i)); err == nil {
+            return dst.IP.String()
+        }
+        return ""
+    }
+    var seq int64
+    wg := sync.WaitGroup{}
+    tasksChan := make(chan icmpTask, numOfgoroutine)
+    for i := 0; i < numOfgoroutine; i++ {
+        go func() {
+            for task := range tasksChan {
+                if ip := hostIP(task); ip != "" {
+                    n := int(atomic.AddInt64(&seq, 1)) & 0xffff
+                    conn.WriteTo(icmpRequest(id, n, payload), &net.IPAddr{IP: net.ParseIP(ip)})
+                }
+                wg.Done()
+            }
+        }()
+    }
+    for _, hosts := range hostMap {
+        for i := 0; i < hosts.Len(); i++ {
+            wg.Add(1)
+            tasksChan <- icmpTask{hosts, i}
+        }
+    }
+    wg.Wait()
+    close(tasksChan)
+    conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout)))
+    <-readerDone
+
+    count, pinged := 0, 0
+    for _, hosts := range hostMap {
+        for i := 0; i < hosts.Len(); i++ {
+            pinged++
+            ok := replied[hostIP(icmpTask{hosts, i})]
+            if ok {
+                count++
+            }
+            if ok || verbose {
+                log.Printf("# icmp %-16s %s\n", hosts.Host(i), yesNo(ok))
+            }
+        }
+    }
+    log.Printf("# icmp: %d/%d hosts replied\n", count, pinged)
+    outbound = append(outbound, "ICMP "+yesNo(count > 0))
+}
+
+// firstTarget returns the first host of the targets on the lowest port, the
+// same on every run, "" without targets
+func firstTarget() string {
+    for _, port := range targetPorts() {
+        rawTargets := append([]string{}, portMap[port]...)
+        sort.Strings(rawTargets)
+        for _, rawTarget := range rawTargets {
+            if hosts := hostMap[rawTarget]; hosts.Len() > 0 {
+                return net.JoinHostPort(hosts.Host(0), port)
+            }
+        }
+    }
+    return ""
+}
+
+// targetPorts returns the ports of the targets in numeric order
+func targetPorts() []string {
+    var ports []string
+    for port := range portMap {
+        ports = append(ports, port)
+    }
+    sort.Slice(ports, func(i, j int) bool {
+        a, _ := strconv.Atoi(ports[i])
+        b, _ := strconv.Atoi(ports[j])
+        return a < b
+    })
+    return ports
+}
+
+// IPv6Egress tests the ports of the targets on the IPv6 address over TCP, or UDP with -u
+func IPv6Egress(host string, ports []string) {
+    addr, err := net.ResolveIPAddr("ip6", host)
+    if err != nil || addr.IP.To4() != nil {
+        log.Printf("# IPv6 egress test failed: %s is not an IPv6 host\n", host)
+        outbound = append(outbound, "IPv6 unknown")
+        return
+    }
+    if !CheckEgressScope(addr.IP.String(), "-6") {
+        outbound = append(outbound, "IPv6 skipped (out of scope)")
+        return
+    }
+    proto := "TCP"
+    if udpmode {
+        proto = "UDP"
+    }
+    log.Printf("\n# %s Start IPv6 egress test %s (%s, reqs: %d)\n\n", time.Now().Format("2006/01/02 15:04:05"), addr.IP, proto, len(ports))
+
+    var lock sync.Mutex
+    passed := make(map[int]bool)
+    wg := sync.WaitGroup{}
+    portsChan := make(chan string, numOfgoroutine)
+    for i := 0; i < numOfgoroutine; i++ {
+        go func() {
+            for port := range portsChan {
+                targetAddr := net.JoinHostPort(addr.IP.String(), port)
+                var flag PortState
+                if udpmode {
+                    flag = UdpConnect(targetAddr)
+                } else {
+                    flag = TcpConnect(targetAddr)
+                }
+                // a sent datagram passed only when the listener verified it
+                if (flag == StateOpen && !udpmode) || flag == StateVerified {
+                    n, _ := strconv.Atoi(port)
+                    lock.Lock()
+                    passed[n] = true
+                    lock.Unlock()
+                    if flag == StateVerified && !udpmode {
+                        log.Printf("%-26s (IPv6) [verified egress]", targetAddr)
+                    } else if !udpmode {
+                        log.Printf("%-26s (IPv6)", targetAddr)
+                    }
+                }
+                wg.Done()
+            }
+        }()
+    }
+    for _, port := range ports {
+        wg.Add(1)
+        portsChan <- port
+    }
+    wg.Wait()
+    close(portsChan)
+
+    switch {
+    case len(passed) > 0:
+        outbound = append(outbound, "IPv6 "+proto+" "+sortedPorts(passed)+" yes")
+    case udpmode && egressKey == "":
+        outbound = append(outbound, "IPv6 UDP sent (see the listener, or -k to verify)")
+    default:
+        outbound = append(outbound, "IPv6 "+proto+" no")
+    }
+}
+
+// serveICMP records the echo requests with the token, the kernel answers them
+func (l *EgressListener) serveICMP(conn net.PacketConn) {
+    buf := make([]byte, 1500)
+    for {
+        n, addr, err := conn.ReadFrom(buf)
+        if err != nil {
+            continue
+        }
+        if n < 8 || buf[0] != 8 { // echo request
+            continue
+        }
+        check := checkICMPToken(buf[8:n])
+        if check == "" {
+            continue
+        }
+        l.mutex.Lock()
+        r := l.recordOf(addr.String())
+        r.icmp = true
+        if check == "verified" {
+            r.verified["icmp"] = true
+        }
+        log.Printf("# icmp %-21s (%s)\n", addr.String(), check)
+        l.mutex.Unlock()
+    }
+}
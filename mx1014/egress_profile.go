@@ -0,0 +1,286 @@
+package mx1014
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "fmt"
+    "io"
+    "math/big"
+    "net"
+    "net/http"
+    "net/url"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Egress probe profiles (-pr), the echo data is wrapped in a realistic protocol
+// opening, because a DPI firewall may only let real TLS out on 443 or real HTTP
+// on 80. A profile is completed when the listener (-L) answered the protocol
+// with the proof of the nonce of the probe, a block page of a DPI box or the
+// banner of an intercepting proxy has no proof:
+//   tls   ClientHello with the SNI (-sni), "<echo data> <nonce>" in the tunnel, the proof line
+//   http  GET /<echo data> with the Host header (-sni) and X-MX1014: <nonce>, X-MX1014: <proof>
+//   ssh   SSH-2.0 version string with "<echo data> <nonce>" as comment, the proof as comment
+
+const (
+    sshBanner    = "SSH-2.0-OpenSSH_8.9p1"
+    profileField = "X-MX1014"
+    noncePrefix  = "mx1014-"
+)
+
+var egressProfileNames = []string{"tls", "http", "ssh"}
+
+var (
+    profiles          []string       // the profiles of -pr
+    profileCompleted  map[string]int // profile: completed exchanges
+    httpRequestRegexp = regexp.MustCompile(`^[A-Z]+ (\S+) HTTP/1\.[01]\r?\n`)
+)
+
+// ParseEgressProfiles parses the profile list of -pr, e.g. tls,http or all
+func ParseEgressProfiles(list string) ([]string, error) {
+    var names []string
+    seen := make(map[string]bool)
+    for _, name := range strings.Split(list, ",") {
+        name = strings.ToLower(strings.TrimSpace(name))
+        var items []string
+        if name == "all" {
+            items = egressProfileNames
+        } else {
+            items = []string{name}
+        }
+        for _, item := range items {
+            if !isEgressProfile(item) {
+                return nil, fmt.Errorf("unknown egress profile %q (%s)", item, strings.Join(egressProfileNames, ","))
+            }
+            if !seen[item] {
+                seen[item] = true
+                names = append(names, item)
+            }
+        }
+    }
+    return names, nil
+}
+
+func isEgressProfile(name string) bool {
+    for _, profile := range egressProfileNames {
+        if name == profile {
+            return true
+        }
+    }
+    return false
+}
+
+func echoData(port string) string {
+    return strings.Replace(senddata, "%port%", port, -1)
+}
+
+// profileProof is the answer of the listener to the nonce of a profile probe,
+// keyed with -k when it is set
+func profileProof(nonce string) string {
+    return noncePrefix + egressMAC("profile", nonce, "")
+}
+
+// splitNonce takes the nonce off the end of the data of a profile probe
+func splitNonce(data []byte) ([]byte, string) {
+    data = bytes.TrimSpace(data)
+    i := bytes.LastIndexByte(data, ' ')
+    if i < 0 || !bytes.HasPrefix(data[i+1:], []byte(noncePrefix)) {
+        return data, ""
+    }
+    return bytes.TrimSpace(data[:i]), string(data[i+1:])
+}
+
+// dialProfile connects to the target, through the proxy of the proxy egress test if set
+func dialProfile(targetAddr string) (net.Conn, error) {
+    if proxyURL == nil {
+        return net.DialTimeout("tcp", targetAddr, time.Millisecond*time.Duration(timeout))
+    }
+    status, _, conn, err := proxyConnect(targetAddr, true)
+    if err != nil {
+        return nil, err
+    }
+    if status != http.StatusOK {
+        conn.Close()
+        return nil, fmt.Errorf("proxy %d", status)
+    }
+    return conn, nil
+}
+
+// probeProfile runs one profile on a new connection, true if the exchange completed
+func probeProfile(profile string, targetAddr string) bool {
+    conn, err := dialProfile(targetAddr)
+    if err != nil {
+        return false
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout) * 2))
+    port := addrPort(targetAddr)
+    nonce := noncePrefix + newRunID()
+    proof := profileProof(nonce)
+
+    switch profile {
+    case "tls":
+        tlsConn := tls.Client(conn, &tls.Config{ServerName: sniName, InsecureSkipVerify: true})
+        if err := tlsConn.Handshake(); err != nil {
+            return false
+        }
+        if _, err := tlsConn.Write([]byte(strings.TrimSpace(echoData(port)) + " " + nonce + "\n")); err != nil {
+            return false
+        }
+        line, _ := bufio.NewReader(tlsConn).ReadString('\n')
+        return strings.TrimSpace(line) == proof
+    case "http":
+        request := "GET /" + url.PathEscape(strings.TrimSpace(echoData(port))) + " HTTP/1.1\r\n" +
+            "Host: " + sniName + "\r\n" +
+            "User-Agent: Mozilla/5.0 (Windows NT 10.0; Win64; x64)\r\n" +
+            "Accept: */*\r\n" +
+            profileField + ": " + nonce + "\r\n" +
+            "Connection: close\r\n\r\n"
+        if _, err := conn.Write([]byte(request)); err != nil {
+            return false
+        }
+        resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+        if err != nil {
+            return false
+        }
+        resp.Body.Close()
+        return resp.Header.Get(profileField) == proof
+    case "ssh":
+        if _, err := conn.Write([]byte(sshBanner + " " + strings.TrimSpace(echoData(port)) + " " + nonce + "\r\n")); err != nil {
+            return false
+        }
+        line, _ := bufio.NewReader(conn).ReadString('\n')
+        return strings.HasPrefix(line, "SSH-") && strings.HasSuffix(strings.TrimSpace(line), " "+proof)
+    }
+    return false
+}
+
+// ProbeProfiles runs the profiles of -pr on an open port, returns the tag of the output
+func ProbeProfiles(targetAddr string) string {
+    var results []string
+    for _, profile := range profiles {
+        if probeProfile(profile, targetAddr) {
+            results = append(results, profile+" ok")
+            mutex.Lock()
+            profileCompleted[profile]++
+            mutex.Unlock()
+        } else {
+            results = append(results, profile+" no")
+        }
+    }
+    return " [" + strings.Join(results, ", ") + "]"
+}
+
+// ProfileSummary: tls: 3/5, http: 5/5, ssh: 0/5
+func ProfileSummary() string {
+    var items []string
+    for _, profile := range profiles {
+        items = append(items, fmt.Sprintf("%s: %d/%d", profile, profileCompleted[profile], openCount))
+    }
+    return strings.Join(items, ", ")
+}
+
+// prefixConn replays the bytes already read from the connection
+type prefixConn struct {
+    net.Conn
+    reader io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+    return c.reader.Read(b)
+}
+
+// selfSignedConfig is the TLS config of the listener, a throwaway certificate
+func selfSignedConfig() (*tls.Config, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(time.Now().UnixNano()),
+        Subject:      pkix.Name{CommonName: "localhost"},
+        NotBefore:    time.Now().Add(-time.Hour * 24),
+        NotAfter:     time.Now().Add(time.Hour * 24 * 365),
+        KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return nil, err
+    }
+    cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+    return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// answerProfile completes the protocol exchange of a profile probe on the
+// listener, returns the profile ("" if the data is not a profile) and the echo data
+func (l *EgressListener) answerProfile(conn net.Conn, data []byte) (string, []byte) {
+    switch {
+    case len(data) > 5 && data[0] == 0x16 && data[1] == 0x03 && l.tlsConfig != nil: // TLS handshake record
+        tlsConn := tls.Server(&prefixConn{conn, io.MultiReader(bytes.NewReader(data), conn)}, l.tlsConfig)
+        if err := tlsConn.Handshake(); err != nil {
+            return "", data
+        }
+        buf := make([]byte, 4096)
+        n, _ := tlsConn.Read(buf)
+        echo, nonce := splitNonce(buf[:n])
+        if nonce != "" {
+            tlsConn.Write([]byte(profileProof(nonce) + "\n"))
+        }
+        profile := "tls"
+        if sni := tlsConn.ConnectionState().ServerName; sni != "" {
+            profile += " " + sni
+        }
+        return profile, echo
+    case httpRequestRegexp.Match(data):
+        proof := ""
+        for _, line := range strings.Split(string(data), "\n") {
+            if items := strings.SplitN(line, ":", 2); len(items) == 2 && strings.EqualFold(items[0], profileField) {
+                proof = profileField + ": " + profileProof(strings.TrimSpace(items[1])) + "\r\n"
+            }
+        }
+        conn.Write([]byte("HTTP/1.1 200 OK\r\n" + proof + "Content-Length: 0\r\nConnection: close\r\n\r\n"))
+        path := strings.TrimPrefix(string(httpRequestRegexp.FindSubmatch(data)[1]), "/")
+        if unescaped, err := url.PathUnescape(path); err == nil {
+            path = unescaped
+        }
+        profile := "http"
+        for _, line := range strings.Split(string(data), "\n") {
+            if strings.HasPrefix(strings.ToLower(line), "host:") {
+                profile += " " + strings.TrimSpace(line[5:])
+            }
+        }
+        return profile, []byte(path)
+    case bytes.HasPrefix(data, []byte("SSH-")):
+        line := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+        comment := ""
+        if i := strings.Index(line, " "); i > 0 {
+            comment = line[i+1:]
+        }
+        echo, nonce := splitNonce([]byte(comment))
+        if nonce != "" {
+            conn.Write([]byte(sshBanner + " " + profileProof(nonce) + "\r\n"))
+        } else {
+            conn.Write([]byte(sshBanner + "\r\n"))
+        }
+        return "ssh", echo
+    }
+    return "", data
+}
+
+func sortedKeys(set map[string]bool) string {
+    var keys []string
+    for key := range set {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return strings.Join(keys, ",")
+}
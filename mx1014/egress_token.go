@@ -0,0 +1,81 @@
+package mx1014
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// The authenticated egress test (-k), the client sends
+//   MX1014 <run id> <port> <mac>
+// and the listener (-L) replies
+//   MX1014-ACK <run id> <port> <mac>
+// the macs are HMAC-SHA256 with the shared key, so a middlebox that answers
+// every port (transparent proxy, synproxy) can not fake the reply
+
+var egressRunID = newRunID()
+
+func newRunID() string {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        return strconv.FormatInt(time.Now().UnixNano(), 16)
+    }
+    return hex.EncodeToString(b)
+}
+
+func egressMAC(kind string, runID string, port string) string {
+    mac := hmac.New(sha256.New, []byte(egressKey))
+    mac.Write([]byte(kind + "|" + runID + "|" + port))
+    return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func EgressToken(port string) string {
+    return "MX1014 " + egressRunID + " " + port + " " + egressMAC("req", egressRunID, port) + "\n"
+}
+
+// parseEgressMessage parses and verifies "<kind> <run id> <port> <mac>"
+func parseEgressMessage(data []byte, kind string, macKind string) (string, string, bool) {
+    fields := strings.Fields(string(data))
+    if len(fields) != 4 || fields[0] != kind {
+        return "", "", false
+    }
+    runID, port, mac := fields[1], fields[2], fields[3]
+    if !hmac.Equal([]byte(mac), []byte(egressMAC(macKind, runID, port))) {
+        return "", "", false
+    }
+    return runID, port, true
+}
+
+// EgressAck returns the signed acknowledgment of a valid token, ok is false if the token is invalid
+func EgressAck(data []byte) (string, int, bool) {
+    runID, port, ok := parseEgressMessage(data, "MX1014", "req")
+    if !ok {
+        return "", 0, false
+    }
+    portNum, err := strconv.Atoi(port)
+    if err != nil {
+        return "", 0, false
+    }
+    return "MX1014-ACK " + runID + " " + port + " " + egressMAC("ack", runID, port) + "\n", portNum, true
+}
+
+// VerifyEgress sends the token over the connection and verifies the reply of the listener
+func VerifyEgress(conn net.Conn, port string) bool {
+    deadline := time.Now().Add(time.Millisecond * time.Duration(timeout))
+    conn.SetDeadline(deadline)
+    if _, err := conn.Write([]byte(EgressToken(port))); err != nil {
+        return false
+    }
+    buf := make([]byte, 512)
+    n, err := conn.Read(buf)
+    if err != nil {
+        return false
+    }
+    runID, ackPort, ok := parseEgressMessage(buf[:n], "MX1014-ACK", "ack")
+    return ok && runID == egressRunID && ackPort == port
+}
@@ -0,0 +1,259 @@
+//go:build linux
+// +build linux
+
+package mx1014
+
+import (
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// EpollEngine is the non-blocking connect engine (-epoll): the connects are
+// issued without blocking and their completions are harvested by epoll, so
+// thousands of probes in flight need a few goroutines instead of one each.
+// The errors go through ClassifyConnectError like TcpConnect. The results are
+// handed to epollWorkers goroutines, a slow done (e.g. -pr) never stalls the poll
+type EpollEngine struct {
+    epfd     int
+    mutex    sync.Mutex
+    cond     *sync.Cond
+    probes   map[int]*epollProbe // fd: probe
+    inflight int
+    max      int
+    timeout  time.Duration
+    results  chan epollResult
+    resolved sync.Map // host: net.IP or error, each host is resolved once
+}
+
+type epollResult struct {
+    flag PortState
+    done func(flag PortState)
+}
+
+const epollWorkers = 16
+
+type epollProbe struct {
+    fd         int
+    targetAddr string
+    deadline   time.Time
+    done       func(flag PortState)
+}
+
+func NewEpollEngine(max int) (*EpollEngine, error) {
+    epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+    if err != nil {
+        return nil, os.NewSyscallError("epoll_create1", err)
+    }
+    e := &EpollEngine{
+        epfd:    epfd,
+        probes:  make(map[int]*epollProbe),
+        max:     max,
+        timeout: time.Millisecond * time.Duration(timeout),
+        results: make(chan epollResult, max),
+    }
+    e.cond = sync.NewCond(&e.mutex)
+    go e.poll()
+    for i := 0; i < epollWorkers; i++ {
+        go func() {
+            for r := range e.results {
+                r.done(r.flag)
+            }
+        }()
+    }
+    return e, nil
+}
+
+// resolve returns the address of host:port, the hostnames are looked up once
+func (e *EpollEngine) resolve(targetAddr string) (net.IP, int, error) {
+    host, portStr, err := net.SplitHostPort(targetAddr)
+    if err != nil {
+        return nil, 0, err
+    }
+    port, err := strconv.Atoi(portStr)
+    if err != nil {
+        return nil, 0, &net.AddrError{Err: "invalid port", Addr: targetAddr}
+    }
+    if ip := net.ParseIP(host); ip != nil {
+        return ip, port, nil
+    }
+    value, ok := e.resolved.Load(host)
+    if !ok {
+        if addr, err := net.ResolveIPAddr("ip", host); err != nil {
+            value = err
+        } else {
+            value = addr.IP
+        }
+        e.resolved.Store(host, value)
+    }
+    if err, ok := value.(error); ok {
+        return nil, 0, err
+    }
+    return value.(net.IP), port, nil
+}
+
+func connectError(err error) error {
+    return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+}
+
+// Connect starts the connect, done is called with the state of the port
+func (e *EpollEngine) Connect(targetAddr string, done func(flag PortState)) {
+    e.mutex.Lock()
+    for e.inflight >= e.max {
+        e.cond.Wait()
+    }
+    e.inflight++
+    e.mutex.Unlock()
+
+    ip, port, err := e.resolve(targetAddr)
+    if err != nil {
+        e.finish(nil, ClassifyConnectError(targetAddr, err), done)
+        return
+    }
+    family := syscall.AF_INET
+    var sockaddr syscall.Sockaddr
+    if ip4 := ip.To4(); ip4 != nil {
+        sa := &syscall.SockaddrInet4{Port: port}
+        copy(sa.Addr[:], ip4)
+        sockaddr = sa
+    } else {
+        family = syscall.AF_INET6
+        sa := &syscall.SockaddrInet6{Port: port}
+        copy(sa.Addr[:], ip.To16())
+        sockaddr = sa
+    }
+    fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+    if err != nil {
+        e.finish(nil, ClassifyConnectError(targetAddr, os.NewSyscallError("socket", err)), done)
+        return
+    }
+    p := &epollProbe{fd: fd, targetAddr: targetAddr, deadline: time.Now().Add(e.timeout), done: done}
+    err = syscall.Connect(fd, sockaddr)
+    if err == nil {
+        e.connected(p)
+        return
+    }
+    if err != syscall.EINPROGRESS {
+        syscall.Close(fd)
+        e.finish(nil, ClassifyConnectError(targetAddr, connectError(err)), done)
+        return
+    }
+
+    e.mutex.Lock()
+    e.probes[fd] = p
+    e.mutex.Unlock()
+    event := syscall.EpollEvent{Events: syscall.EPOLLOUT, Fd: int32(fd)}
+    if err := syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+        if e.take(fd) != nil {
+            syscall.Close(fd)
+            e.finish(nil, ClassifyConnectError(targetAddr, os.NewSyscallError("epoll_ctl", err)), done)
+        }
+    }
+}
+
+// take removes the probe of the fd, nil if it is already finished
+func (e *EpollEngine) take(fd int) *epollProbe {
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    p := e.probes[fd]
+    delete(e.probes, fd)
+    return p
+}
+
+func (e *EpollEngine) connected(p *epollProbe) {
+    if selfConnect(p.fd) {
+        // the loopback connect got its own port as the source, like net.Dial
+        // this means the port is closed
+        syscall.Close(p.fd)
+        e.finish(p, StateClosed, p.done)
+        return
+    }
+    if echoMode {
+        syscall.Write(p.fd, []byte(strings.Replace(senddata, "%port%", addrPort(p.targetAddr), -1)))
+    } else {
+        // like TcpConnect, reset instead of leaving a TIME_WAIT socket
+        syscall.SetsockoptLinger(p.fd, syscall.SOL_SOCKET, syscall.SO_LINGER, &syscall.Linger{Onoff: 1, Linger: 0})
+    }
+    syscall.Close(p.fd)
+    e.finish(p, StateOpen, p.done)
+}
+
+func selfConnect(fd int) bool {
+    local, err := syscall.Getsockname(fd)
+    if err != nil {
+        return false
+    }
+    remote, err := syscall.Getpeername(fd)
+    if err != nil {
+        return false
+    }
+    switch l := local.(type) {
+    case *syscall.SockaddrInet4:
+        r, ok := remote.(*syscall.SockaddrInet4)
+        return ok && l.Port == r.Port && l.Addr == r.Addr
+    case *syscall.SockaddrInet6:
+        r, ok := remote.(*syscall.SockaddrInet6)
+        return ok && l.Port == r.Port && l.Addr == r.Addr
+    }
+    return false
+}
+
+func (e *EpollEngine) finish(p *epollProbe, flag PortState, done func(flag PortState)) {
+    e.mutex.Lock()
+    e.inflight--
+    e.mutex.Unlock()
+    e.cond.Signal()
+    e.results <- epollResult{flag: flag, done: done}
+}
+
+func (e *EpollEngine) poll() {
+    events := make([]syscall.EpollEvent, 512)
+    for {
+        n, err := syscall.EpollWait(e.epfd, events, 100)
+        if err != nil && err != syscall.EINTR {
+            ErrPrint("epoll_wait: " + err.Error())
+        }
+        for i := 0; i < n; i++ {
+            fd := int(events[i].Fd)
+            p := e.take(fd)
+            if p == nil {
+                continue
+            }
+            syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+            errno, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+            if err == nil && errno == 0 {
+                e.connected(p)
+                continue
+            }
+            syscall.Close(fd)
+            if err == nil {
+                err = connectError(syscall.Errno(errno))
+            }
+            e.finish(p, ClassifyConnectError(p.targetAddr, err), p.done)
+        }
+        e.expire()
+    }
+}
+
+// expire finishes the probes past the deadline as filtered, like the timeout of TcpConnect
+func (e *EpollEngine) expire() {
+    now := time.Now()
+    var expired []*epollProbe
+    e.mutex.Lock()
+    for fd, p := range e.probes {
+        if now.After(p.deadline) {
+            expired = append(expired, p)
+            delete(e.probes, fd)
+        }
+    }
+    e.mutex.Unlock()
+    for _, p := range expired {
+        syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_DEL, p.fd, nil)
+        syscall.Close(p.fd)
+        e.finish(p, StateFiltered, p.done)
+    }
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package mx1014
+
+import (
+    "errors"
+)
+
+// EpollEngine is only supported on linux
+type EpollEngine struct{}
+
+func NewEpollEngine(max int) (*EpollEngine, error) {
+    return nil, errors.New("the epoll engine (-epoll) is only supported on linux")
+}
+
+func (e *EpollEngine) Connect(targetAddr string, done func(flag PortState)) {
+    done(StateUnknown)
+}
@@ -0,0 +1,208 @@
+package mx1014
+
+import (
+    "net"
+    "sort"
+    "strings"
+)
+
+type addrRange struct {
+    start uint32
+    end   uint32 // inclusive
+}
+
+// HostMatcher matches hosts against a list of targets (CIDR, wildcard, range, hostname)
+type HostMatcher struct {
+    ranges []addrRange
+    names  map[string]bool
+}
+
+func NewHostMatcher(targets []string) (*HostMatcher, error) {
+    m := &HostMatcher{names: make(map[string]bool)}
+    for _, target := range targets {
+        target = strings.Split(target, ":")[0]
+        if _, ipnet, err := net.ParseCIDR(target); err == nil && ipnet.IP.To4() != nil {
+            // the whole block, including the network and broadcast address
+            ones, bits := ipnet.Mask.Size()
+            start := IPToUint32(ipnet.IP)
+            m.ranges = append(m.ranges, addrRange{start, start + uint32(uint64(1)<<uint(bits-ones)-1)})
+            continue
+        }
+        // the names are matched even if they do not resolve
+        hosts, err := ExpandHosts(target)
+        if err != nil {
+            return nil, err
+        }
+        if ipSet, ok := hosts.(IPSet); ok {
+            for i := 0; i < ipSet.Len(); i++ {
+                m.addAddr(ipSet.Addr(i))
+            }
+            continue
+        }
+        for i := 0; i < hosts.Len(); i++ {
+            host := hosts.Host(i)
+            m.names[strings.ToLower(host)] = true
+            addrs, _ := net.LookupHost(host)
+            for _, addr := range addrs {
+                if ip := net.ParseIP(addr).To4(); ip != nil {
+                    m.addAddr(IPToUint32(ip))
+                }
+            }
+        }
+    }
+    m.merge()
+    return m, nil
+}
+
+func (m *HostMatcher) addAddr(addr uint32) {
+    if n := len(m.ranges); n > 0 && m.ranges[n-1].end+1 == addr && m.ranges[n-1].end != 0xffffffff {
+        m.ranges[n-1].end = addr
+        return
+    }
+    m.ranges = append(m.ranges, addrRange{addr, addr})
+}
+
+func (m *HostMatcher) merge() {
+    sort.Slice(m.ranges, func(i, j int) bool {
+        return m.ranges[i].start < m.ranges[j].start
+    })
+    var merged []addrRange
+    for _, r := range m.ranges {
+        n := len(merged)
+        if n > 0 && (r.start <= merged[n-1].end || r.start == merged[n-1].end+1) {
+            if r.end > merged[n-1].end {
+                merged[n-1].end = r.end
+            }
+            continue
+        }
+        merged = append(merged, r)
+    }
+    m.ranges = merged
+}
+
+func (m *HostMatcher) Len() int {
+    return len(m.ranges) + len(m.names)
+}
+
+func (m *HostMatcher) ContainsAddr(addr uint32) bool {
+    i := sort.Search(len(m.ranges), func(i int) bool {
+        return m.ranges[i].end >= addr
+    })
+    return i < len(m.ranges) && m.ranges[i].start <= addr
+}
+
+// ContainsHost matches the hostname itself or any of its IPv4 addresses
+func (m *HostMatcher) ContainsHost(host string) bool {
+    if m.names[strings.ToLower(host)] {
+        return true
+    }
+    if ip := net.ParseIP(host); ip != nil {
+        return ip.To4() != nil && m.ContainsAddr(IPToUint32(ip))
+    }
+    addrs, _ := net.LookupHost(host)
+    for _, addr := range addrs {
+        if ip := net.ParseIP(addr).To4(); ip != nil && m.ContainsAddr(IPToUint32(ip)) {
+            return true
+        }
+    }
+    return false
+}
+
+func (m *HostMatcher) contains(hosts HostSet, i int) bool {
+    if ipSet, ok := hosts.(IPSet); ok {
+        return m.ContainsAddr(ipSet.Addr(i))
+    }
+    return m.ContainsHost(hosts.Host(i))
+}
+
+// filteredSet is a HostSet with some index ranges of the underlying set removed
+type filteredSet struct {
+    set   HostSet
+    skips []indexSkip
+    size  int
+}
+
+type indexSkip struct {
+    start          int // first removed index
+    end            int // last removed index
+    keptBefore     int // kept hosts before start
+    removedThrough int // removed hosts up to end
+}
+
+func (f *filteredSet) Len() int {
+    return f.size
+}
+
+func (f *filteredSet) index(i int) int {
+    j := sort.Search(len(f.skips), func(j int) bool {
+        return f.skips[j].keptBefore > i
+    })
+    if j == 0 {
+        return i
+    }
+    return i + f.skips[j-1].removedThrough
+}
+
+func (f *filteredSet) Host(i int) string {
+    return f.set.Host(f.index(i))
+}
+
+type filteredIPSet struct {
+    filteredSet
+}
+
+func (f *filteredIPSet) Addr(i int) uint32 {
+    return f.set.(IPSet).Addr(f.index(i))
+}
+
+// FilterHosts returns the hosts without the removed ones, and the number of removed hosts
+func FilterHosts(hosts HostSet, remove func(hosts HostSet, i int) bool) (HostSet, int) {
+    f := filteredSet{set: hosts}
+    removed := 0
+    for i := 0; i < hosts.Len(); i++ {
+        if !remove(hosts, i) {
+            continue
+        }
+        removed++
+        n := len(f.skips)
+        if n > 0 && f.skips[n-1].end+1 == i {
+            f.skips[n-1].end = i
+            f.skips[n-1].removedThrough = removed
+        } else {
+            f.skips = append(f.skips, indexSkip{start: i, end: i, keptBefore: i - removed + 1, removedThrough: removed})
+        }
+    }
+    if removed == 0 {
+        return hosts, 0
+    }
+    f.size = hosts.Len() - removed
+    if _, ok := hosts.(IPSet); ok {
+        return &filteredIPSet{f}, removed
+    }
+    return &f, removed
+}
+
+// RemoveHosts removes the hosts from hostMap and corrects the counters
+func RemoveHosts(remove func(hosts HostSet, i int) bool) int {
+    removedMap := make(map[string]int) // rawtarget: removed hosts
+    count := 0
+    for rawTarget, hosts := range hostMap {
+        filtered, removed := FilterHosts(hosts, remove)
+        if removed > 0 {
+            hostMap[rawTarget] = filtered
+            removedMap[rawTarget] = removed
+            hostTotal -= removed
+            count += removed
+        }
+    }
+    for _, rawTargets := range portMap {
+        for _, rawTarget := range rawTargets {
+            total -= removedMap[rawTarget]
+        }
+    }
+    return count
+}
+
+func ExcludeHosts(matcher *HostMatcher) int {
+    return RemoveHosts(matcher.contains)
+}
@@ -0,0 +1,143 @@
+package mx1014
+
+import (
+    "reflect"
+    "testing"
+)
+
+// lastOctets returns the last octet of each address of the set, and checks
+// that Host and Addr agree
+func lastOctets(t *testing.T, hosts HostSet) []int {
+    ipSet, ok := hosts.(IPSet)
+    if !ok {
+        t.Fatalf("%T is not an IPSet", hosts)
+    }
+    var octets []int
+    for i := 0; i < ipSet.Len(); i++ {
+        if host := ipSet.Host(i); host != Uint32ToIP(ipSet.Addr(i)) {
+            t.Fatalf("Host(%d) = %s, Addr(%d) = %s", i, host, i, Uint32ToIP(ipSet.Addr(i)))
+        }
+        octets = append(octets, int(ipSet.Addr(i)&0xff))
+    }
+    return octets
+}
+
+func TestFilterHostsExclude(t *testing.T) {
+    tests := []struct {
+        exclude []string
+        octets  []int // of 10.0.0.1-10.0.0.10 after the exclusion
+    }{
+        {[]string{"10.0.1.1"}, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+        {[]string{"10.0.0.1"}, []int{2, 3, 4, 5, 6, 7, 8, 9, 10}},
+        {[]string{"10.0.0.1-10.0.0.3"}, []int{4, 5, 6, 7, 8, 9, 10}},
+        {[]string{"10.0.0.5"}, []int{1, 2, 3, 4, 6, 7, 8, 9, 10}},
+        {[]string{"10.0.0.4-10.0.0.7"}, []int{1, 2, 3, 8, 9, 10}},
+        {[]string{"10.0.0.10"}, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}},
+        {[]string{"10.0.0.9-10.0.0.20"}, []int{1, 2, 3, 4, 5, 6, 7, 8}},
+        {[]string{"10.0.0.1", "10.0.0.5", "10.0.0.10"}, []int{2, 3, 4, 6, 7, 8, 9}},
+        {[]string{"10.0.0.2,3,7"}, []int{1, 4, 5, 6, 8, 9, 10}},
+        {[]string{"10.0.0.2-10.0.0.5", "10.0.0.4/31", "10.0.0.5-10.0.0.6"}, []int{1, 7, 8, 9, 10}},
+        {[]string{"10.0.0.3-10.0.0.8", "10.0.0.5"}, []int{1, 2, 9, 10}},
+        {[]string{"10.0.0.1-10.0.0.2", "10.0.0.2-10.0.0.3", "10.0.0.9", "10.0.0.8/29"}, []int{4, 5, 6, 7}},
+        {[]string{"10.0.0.0/28"}, nil},
+    }
+    for _, test := range tests {
+        matcher, err := NewHostMatcher(test.exclude)
+        if err != nil {
+            t.Errorf("NewHostMatcher(%q) error: %v", test.exclude, err)
+            continue
+        }
+        hosts := &ipRange{start: 0x0a000001, size: 10}
+        filtered, removed := FilterHosts(hosts, matcher.contains)
+        if octets := lastOctets(t, filtered); !reflect.DeepEqual(octets, test.octets) {
+            t.Errorf("exclude %q = %v, expect %v", test.exclude, octets, test.octets)
+        }
+        if filtered.Len() != len(test.octets) || removed != 10-len(test.octets) {
+            t.Errorf("exclude %q: Len() = %d, removed %d, expect %d, %d",
+                test.exclude, filtered.Len(), removed, len(test.octets), 10-len(test.octets))
+        }
+    }
+}
+
+func TestFilterHostsNames(t *testing.T) {
+    tests := []struct {
+        remove string
+        hosts  []string
+    }{
+        {"", []string{"a", "b", "c", "d", "e", "f"}},
+        {"a", []string{"b", "c", "d", "e", "f"}},
+        {"ab", []string{"c", "d", "e", "f"}},
+        {"c", []string{"a", "b", "d", "e", "f"}},
+        {"cd", []string{"a", "b", "e", "f"}},
+        {"f", []string{"a", "b", "c", "d", "e"}},
+        {"ef", []string{"a", "b", "c", "d"}},
+        {"acf", []string{"b", "d", "e"}},
+        {"abdf", []string{"c", "e"}},
+        {"abcdef", nil},
+    }
+    for _, test := range tests {
+        filtered, removed := FilterHosts(hostList{"a", "b", "c", "d", "e", "f"}, func(hosts HostSet, i int) bool {
+            for _, c := range test.remove {
+                if hosts.Host(i) == string(c) {
+                    return true
+                }
+            }
+            return false
+        })
+        var hosts []string
+        for i := 0; i < filtered.Len(); i++ {
+            hosts = append(hosts, filtered.Host(i))
+        }
+        if !reflect.DeepEqual(hosts, test.hosts) || removed != len(test.remove) {
+            t.Errorf("remove %q = %v, removed %d, expect %v, %d", test.remove, hosts, removed, test.hosts, len(test.remove))
+        }
+    }
+}
+
+func TestFilterHostsNested(t *testing.T) {
+    tests := []struct {
+        excludes [][]string // applied one after another
+        octets   []int      // of 10.0.0.1-10.0.0.20 after the exclusions
+    }{
+        {
+            [][]string{{"10.0.0.1-10.0.0.3"}, {"10.0.0.4"}},
+            []int{5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+        },
+        {
+            [][]string{{"10.0.0.5-10.0.0.8"}, {"10.0.0.9", "10.0.0.4"}},
+            []int{1, 2, 3, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+        },
+        {
+            [][]string{{"10.0.0.2", "10.0.0.19"}, {"10.0.0.1", "10.0.0.20"}, {"10.0.0.10-10.0.0.12"}},
+            []int{3, 4, 5, 6, 7, 8, 9, 13, 14, 15, 16, 17, 18},
+        },
+        {
+            [][]string{{"10.0.0.2,4,6,8"}, {"10.0.0.3-10.0.0.7"}, {"10.0.0.1", "10.0.0.9"}},
+            []int{10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+        },
+        {
+            [][]string{{"10.0.0.5-10.0.0.15"}, {"10.0.0.1-10.0.0.10"}, {"10.0.0.16/28"}},
+            nil,
+        },
+    }
+    for _, test := range tests {
+        var hosts HostSet = &ipRange{start: 0x0a000001, size: 20}
+        total := 0
+        for _, exclude := range test.excludes {
+            matcher, err := NewHostMatcher(exclude)
+            if err != nil {
+                t.Fatalf("NewHostMatcher(%q) error: %v", exclude, err)
+            }
+            var removed int
+            hosts, removed = FilterHosts(hosts, matcher.contains)
+            total += removed
+        }
+        if octets := lastOctets(t, hosts); !reflect.DeepEqual(octets, test.octets) {
+            t.Errorf("exclude %q = %v, expect %v", test.excludes, octets, test.octets)
+        }
+        if hosts.Len() != len(test.octets) || total != 20-len(test.octets) {
+            t.Errorf("exclude %q: Len() = %d, removed %d, expect %d, %d",
+                test.excludes, hosts.Len(), total, len(test.octets), 20-len(test.octets))
+        }
+    }
+}
@@ -0,0 +1,279 @@
+package mx1014
+
+import (
+    "encoding/hex"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+var (
+    harvestSources = []string{"hosts", "ssh", "tcp", "dns", "conf"}
+    harvestConfigs = []string{
+        "/etc/*.conf",
+        "/etc/*/*.conf",
+        "/etc/fstab",
+        "/etc/exports",
+        "/etc/environment",
+        "/etc/sysconfig/network-scripts/ifcfg-*",
+        "/etc/network/interfaces",
+    }
+    ipv4Regexp = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+)
+
+// harvester collects targets and remembers where each one was found
+type harvester struct {
+    targets []string
+    sources map[string][]string // target: sources
+}
+
+func (h *harvester) add(target string, source string) {
+    if h.sources[target] == nil {
+        h.targets = append(h.targets, target)
+    }
+    for _, s := range h.sources[target] {
+        if s == source {
+            return
+        }
+    }
+    h.sources[target] = append(h.sources[target], source)
+}
+
+func isHarvestHost(host string) bool {
+    ip := net.ParseIP(host)
+    if ip == nil {
+        // hostname, leave it to ParseTarget
+        return host != "" && host != "localhost" && !strings.ContainsAny(host, "*?[]|/")
+    }
+    ip4 := ip.To4()
+    if ip4 == nil {
+        return false
+    }
+    // x.x.x.255 is a valid host of a /23 or larger, only the broadcast of the local networks is skipped
+    return !ip4.IsLoopback() && !ip4.IsUnspecified() && !ip4.IsMulticast() &&
+        ip4[0] != 255 && !(ip4[0] == 169 && ip4[1] == 254) && !localBroadcasts()[ip4.String()]
+}
+
+var (
+    broadcastOnce sync.Once
+    broadcasts    map[string]bool
+)
+
+// localBroadcasts returns the broadcast addresses of the local IPv4 networks
+func localBroadcasts() map[string]bool {
+    broadcastOnce.Do(func() {
+        broadcasts = make(map[string]bool)
+        addrs, err := net.InterfaceAddrs()
+        if err != nil {
+            return
+        }
+        for _, addr := range addrs {
+            ipNet, ok := addr.(*net.IPNet)
+            if !ok || ipNet.IP.To4() == nil || len(ipNet.Mask) != net.IPv4len {
+                continue
+            }
+            ones, _ := ipNet.Mask.Size()
+            if ones >= 31 {
+                continue // point to point, no broadcast
+            }
+            broadcast := make(net.IP, net.IPv4len)
+            for i, b := range ipNet.IP.To4() {
+                broadcast[i] = b | ^ipNet.Mask[i]
+            }
+            broadcasts[broadcast.String()] = true
+        }
+    })
+    return broadcasts
+}
+
+func homeDirs() []string {
+    dirs := []string{}
+    if home := os.Getenv("HOME"); home != "" {
+        dirs = append(dirs, home)
+    }
+    dirs = append(dirs, "/root")
+    if matches, err := filepath.Glob("/home/*"); err == nil {
+        dirs = append(dirs, matches...)
+    }
+    return RemoveRepeatedElement(dirs)
+}
+
+// /etc/hosts: "ip name [alias...]"
+func harvestEtcHosts(h *harvester) {
+    for _, line := range readLines("/etc/hosts") {
+        fields := strings.Fields(line)
+        if len(fields) > 0 && isHarvestHost(fields[0]) {
+            h.add(fields[0], "/etc/hosts")
+        }
+    }
+}
+
+// known_hosts: "host1,[host2]:port keytype key" and ssh config "HostName host"
+func harvestSSH(h *harvester) {
+    for _, home := range homeDirs() {
+        knownHosts := filepath.Join(home, ".ssh", "known_hosts")
+        for _, line := range readLines(knownHosts) {
+            fields := strings.Fields(line)
+            if len(fields) < 2 || strings.HasPrefix(fields[0], "|") || strings.HasPrefix(fields[0], "@") {
+                continue // hashed or marker entries
+            }
+            for _, entry := range strings.Split(fields[0], ",") {
+                host, port := entry, "ssh"
+                if strings.HasPrefix(entry, "[") {
+                    if i := strings.Index(entry, "]:"); i > 0 {
+                        host, port = entry[1:i], entry[i+2:]
+                    }
+                }
+                if isHarvestHost(host) {
+                    h.add(host+":"+port, knownHosts)
+                }
+            }
+        }
+
+        sshConfig := filepath.Join(home, ".ssh", "config")
+        for _, line := range readLines(sshConfig) {
+            fields := strings.Fields(line)
+            if len(fields) >= 2 && strings.EqualFold(fields[0], "HostName") && isHarvestHost(fields[1]) {
+                h.add(fields[1]+":ssh", sshConfig)
+            }
+        }
+    }
+}
+
+// /proc/net/tcp addresses are "0100007F:0016", the ip in host byte order (little endian),
+// /proc/net/tcp6 ones are four such 32 bit words
+func parseProcAddr(addr string) (string, int, error) {
+    items := strings.Split(addr, ":")
+    if len(items) != 2 || (len(items[0]) != 8 && len(items[0]) != 32) {
+        return "", 0, fmt.Errorf("wrong address: %s", addr)
+    }
+    b, err := hex.DecodeString(items[0])
+    if err != nil {
+        return "", 0, err
+    }
+    port, err := strconv.ParseInt(items[1], 16, 32)
+    if err != nil {
+        return "", 0, err
+    }
+    ip := make(net.IP, len(b))
+    for i := 0; i < len(b); i += 4 {
+        ip[i], ip[i+1], ip[i+2], ip[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+    }
+    return ip.String(), int(port), nil
+}
+
+// established connections, the side with the lower port is regarded as the server.
+// The IPv4 peers of the dual stack sockets are in tcp6 as ::ffff:a.b.c.d
+func harvestProcTCP(h *harvester) {
+    for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+        harvestProcFile(h, path)
+    }
+}
+
+func harvestProcFile(h *harvester, path string) {
+    for i, line := range readLines(path) {
+        fields := strings.Fields(line)
+        if i == 0 || len(fields) < 4 || fields[3] != "01" { // 01 == ESTABLISHED
+            continue
+        }
+        _, localPort, err := parseProcAddr(fields[1])
+        if err != nil {
+            continue
+        }
+        remoteIP, remotePort, err := parseProcAddr(fields[2])
+        if err != nil || !isHarvestHost(remoteIP) {
+            continue
+        }
+        if ip4 := net.ParseIP(remoteIP).To4(); ip4 != nil {
+            remoteIP = ip4.String() // ::ffff:a.b.c.d
+        }
+        if remotePort < localPort {
+            h.add(remoteIP+":"+strconv.Itoa(remotePort), path)
+        } else {
+            h.add(remoteIP, path)
+        }
+    }
+}
+
+func harvestResolvConf(h *harvester) {
+    for _, line := range readLines("/etc/resolv.conf") {
+        fields := strings.Fields(line)
+        if len(fields) >= 2 && fields[0] == "nameserver" && isHarvestHost(fields[1]) {
+            h.add(fields[1]+":dns", "/etc/resolv.conf")
+        }
+    }
+}
+
+func harvestConfigFiles(h *harvester) {
+    for _, pattern := range harvestConfigs {
+        paths, err := filepath.Glob(pattern)
+        if err != nil {
+            continue
+        }
+        for _, path := range paths {
+            if path == "/etc/resolv.conf" {
+                continue
+            }
+            for _, line := range readLines(path) {
+                for _, ip := range ipv4Regexp.FindAllString(line, -1) {
+                    if isHarvestHost(ip) {
+                        h.add(ip, path)
+                    }
+                }
+            }
+        }
+    }
+}
+
+// HarvestTargets collects targets from the artifacts of the local host
+// sources: hosts,ssh,tcp,dns,conf or all
+func HarvestTargets(sources string) []string {
+    h := &harvester{sources: make(map[string][]string)}
+    if sources == "all" {
+        sources = strings.Join(harvestSources, ",")
+    }
+    for _, source := range strings.Split(sources, ",") {
+        switch source {
+        case "hosts":
+            harvestEtcHosts(h)
+        case "ssh":
+            harvestSSH(h)
+        case "tcp":
+            harvestProcTCP(h)
+        case "dns":
+            harvestResolvConf(h)
+        case "conf":
+            harvestConfigFiles(h)
+        default:
+            ErrPrint(fmt.Sprintf("Wrong harvest source (-H): %s", source))
+        }
+    }
+
+    for _, target := range h.targets {
+        host := strings.Split(target, ":")[0]
+        for _, source := range h.sources[target] {
+            targetSource[host] = appendSource(targetSource[host], source)
+        }
+        log.Printf("# harvest: %-26s (%s)\n", target, strings.Join(h.sources[target], ","))
+    }
+    log.Printf("# harvest %d targets from local host\n", len(h.targets))
+    return h.targets
+}
+
+func appendSource(labels string, source string) string {
+    if labels == "" {
+        return source
+    }
+    for _, label := range strings.Split(labels, ",") {
+        if label == source {
+            return labels
+        }
+    }
+    return labels + "," + source
+}
@@ -0,0 +1,137 @@
+package mx1014
+
+import (
+    "fmt"
+    "hash/fnv"
+    "log"
+    "sync"
+)
+
+// FilterTable is the filter count of each host (see SendPacket), sharded by the
+// hash of the host so that the probes of different hosts do not share a lock
+type FilterTable struct {
+    shards [64]filterShard
+}
+
+type filterShard struct {
+    mutex  sync.Mutex
+    counts map[string]int
+}
+
+func NewFilterTable() *FilterTable {
+    t := &FilterTable{}
+    for i := range t.shards {
+        t.shards[i].counts = make(map[string]int)
+    }
+    return t
+}
+
+func (t *FilterTable) shard(host string) *filterShard {
+    h := fnv.New32a()
+    h.Write([]byte(host))
+    return &t.shards[h.Sum32()%uint32(len(t.shards))]
+}
+
+func (t *FilterTable) Get(host string) int {
+    s := t.shard(host)
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.counts[host]
+}
+
+// MarkUp marks the host alive, true if it is the first time
+func (t *FilterTable) MarkUp(host string) bool {
+    s := t.shard(host)
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.counts[host] < 65536 {
+        s.counts[host] = 65536
+        return true
+    }
+    return false
+}
+
+// AddFiltered counts a filtered probe of a host that is not alive, returns the new count
+func (t *FilterTable) AddFiltered(host string) int {
+    s := t.shard(host)
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.counts[host] >= 65536 {
+        return s.counts[host]
+    }
+    s.counts[host]++
+    return s.counts[host]
+}
+
+// Discard stops the scan of the host
+func (t *FilterTable) Discard(host string) {
+    s := t.shard(host)
+    s.mutex.Lock()
+    s.counts[host] = autoDiscard + 1
+    s.mutex.Unlock()
+}
+
+// outputLine is a result line, printed by the single output writer
+type outputLine struct {
+    text  string
+    toLog bool // log (and -o) or only stdout
+}
+
+var (
+    outputChan    chan outputLine
+    outputDone    chan struct{}
+    outputMutex   sync.RWMutex // the senders hold the read lock, StopOutput the write lock
+    outputStopped = true
+)
+
+// StartOutput starts the output writer of the results
+func StartOutput() {
+    outputChan = make(chan outputLine, 4096)
+    outputDone = make(chan struct{})
+    outputStopped = false
+    go func() {
+        for line := range outputChan {
+            if line.toLog {
+                log.Print(line.text)
+            } else {
+                fmt.Print(line.text)
+            }
+        }
+        close(outputDone)
+    }()
+}
+
+// StopOutput waits for the writer to print all the results, it can be called
+// more than once and from any goroutine (exit, interrupt), the results sent
+// after it are printed directly
+func StopOutput() {
+    outputMutex.Lock()
+    if outputStopped {
+        outputMutex.Unlock()
+        return
+    }
+    outputStopped = true
+    close(outputChan)
+    outputMutex.Unlock()
+    <-outputDone
+}
+
+func sendOutput(line outputLine) {
+    outputMutex.RLock()
+    defer outputMutex.RUnlock()
+    if !outputStopped {
+        outputChan <- line
+    } else if line.toLog {
+        log.Print(line.text)
+    } else {
+        fmt.Print(line.text)
+    }
+}
+
+func logResult(format string, args ...interface{}) {
+    sendOutput(outputLine{text: fmt.Sprintf(format, args...), toLog: true})
+}
+
+func printResult(format string, args ...interface{}) {
+    sendOutput(outputLine{text: fmt.Sprintf(format, args...)})
+}
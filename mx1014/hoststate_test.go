@@ -0,0 +1,69 @@
+package mx1014
+
+import (
+    "io/ioutil"
+    "log"
+    "net"
+    "os"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// benchTargets returns an open port of a local listener and a closed port
+func benchTargets(b *testing.B) (string, string, func()) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        b.Fatal(err)
+    }
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            conn.Close()
+        }
+    }()
+    free, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        b.Fatal(err)
+    }
+    closed := free.Addr().String()
+    free.Close()
+    return ln.Addr().String(), closed, func() { ln.Close() }
+}
+
+// BenchmarkSendPacket runs the probe of a PortScan worker (SendPacket, which
+// records the result, and the doneCount) on many goroutines, one in 16 probes
+// to the open port, and reports the probes per second
+//
+//   go test -run NONE -bench SendPacket -benchtime 200000x ./mx1014/
+func BenchmarkSendPacket(b *testing.B) {
+    open, closed, stop := benchTargets(b)
+    defer stop()
+    log.SetOutput(ioutil.Discard)
+    defer log.SetOutput(os.Stderr)
+    defer func(t int, throttle *FileThrottle) {
+        timeout, fileThrottle = t, throttle
+    }(timeout, fileThrottle)
+    timeout = 1000
+    fileThrottle = NewFileThrottle(1 << 20)
+    StartOutput()
+    defer StopOutput()
+
+    b.SetParallelism(64)
+    b.ResetTimer()
+    start := time.Now()
+    b.RunParallel(func(pb *testing.PB) {
+        for i := 0; pb.Next(); i++ {
+            if i%16 == 0 {
+                SendPacket(open)
+            } else {
+                SendPacket(closed)
+            }
+            atomic.AddInt64(&doneCount, 1)
+        }
+    })
+    b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pps")
+}
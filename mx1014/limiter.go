@@ -0,0 +1,161 @@
+package mx1014
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// HostLimiter caps the in-flight probes per host, or per /24 (-host-parallel N/24),
+// so that -t 512 against a single target does not trip its per-source connection
+// limit. The probes of a saturated host are parked and dispatched round robin
+// with the other parked hosts, a busy host never blocks the others
+type HostLimiter struct {
+    limit     int
+    perSubnet bool
+    mutex     sync.Mutex
+    inflight  map[string]int
+    pending   map[string][]string
+    ring      []string // the keys with parked probes
+    parked    int
+    maxParked int
+    wake      chan struct{}
+}
+
+// hostLimiter is nil unless -host-parallel is set
+var hostLimiter *HostLimiter
+
+// ParseHostParallel parses "N" or "N/24"
+func ParseHostParallel(value string) (int, bool, error) {
+    items := strings.Split(value, "/")
+    limit, err := strconv.Atoi(items[0])
+    if err != nil || limit < 1 || len(items) > 2 || (len(items) == 2 && items[1] != "24") {
+        return 0, false, fmt.Errorf("wrong host parallel %q, expect N or N/24", value)
+    }
+    return limit, len(items) == 2, nil
+}
+
+func NewHostLimiter(limit int, perSubnet bool, maxParked int) *HostLimiter {
+    return &HostLimiter{
+        limit:     limit,
+        perSubnet: perSubnet,
+        inflight:  make(map[string]int),
+        pending:   make(map[string][]string),
+        maxParked: maxParked,
+        wake:      make(chan struct{}, 1),
+    }
+}
+
+// key of the target (host or host:port): the host, or its /24
+func (l *HostLimiter) key(target string) string {
+    host := addrHost(target)
+    if l.perSubnet {
+        if ip := net.ParseIP(host).To4(); ip != nil {
+            return ip.Mask(net.CIDRMask(24, 32)).String()
+        }
+    }
+    return host
+}
+
+// acquire takes a slot of the target, or parks it
+func (l *HostLimiter) acquire(target string) bool {
+    key := l.key(target)
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    if l.inflight[key] < l.limit && len(l.pending[key]) == 0 {
+        l.inflight[key]++
+        return true
+    }
+    if len(l.pending[key]) == 0 {
+        l.ring = append(l.ring, key)
+    }
+    l.pending[key] = append(l.pending[key], target)
+    l.parked++
+    return false
+}
+
+// popReady takes the parked probes that have a free slot, one per host and round
+func (l *HostLimiter) popReady() []string {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    var ready []string
+    for progress := true; progress; {
+        progress = false
+        for _, key := range l.ring {
+            if l.inflight[key] >= l.limit || len(l.pending[key]) == 0 {
+                continue
+            }
+            queue := l.pending[key]
+            ready = append(ready, queue[0])
+            queue[0] = "" // the backing array lives until the queue is drained
+            l.pending[key] = queue[1:]
+            l.inflight[key]++
+            l.parked--
+            progress = true
+        }
+    }
+    ring := l.ring[:0]
+    for _, key := range l.ring {
+        if len(l.pending[key]) > 0 {
+            ring = append(ring, key)
+        } else {
+            delete(l.pending, key)
+        }
+    }
+    l.ring = ring
+    return ready
+}
+
+// Release frees the slot of a finished probe
+func (l *HostLimiter) Release(target string) {
+    key := l.key(target)
+    l.mutex.Lock()
+    l.inflight[key]--
+    if l.inflight[key] == 0 {
+        delete(l.inflight, key)
+    }
+    l.mutex.Unlock()
+    select {
+    case l.wake <- struct{}{}:
+    default:
+    }
+}
+
+// Dispatch sends the targets of next in order, the saturated hosts are parked.
+// The parked probes are only scanned after a Release woke it up
+func (l *HostLimiter) Dispatch(next func() (string, bool), send func(target string)) {
+    exhausted := false
+    woken := false
+    for {
+        if woken {
+            for _, target := range l.popReady() {
+                send(target)
+            }
+            woken = false
+        }
+        l.mutex.Lock()
+        parked := l.parked
+        l.mutex.Unlock()
+        if !exhausted && parked < l.maxParked {
+            target, ok := next()
+            if !ok {
+                exhausted = true
+            } else if l.acquire(target) {
+                send(target)
+            }
+            select {
+            case <-l.wake:
+                woken = true
+            default:
+            }
+            continue
+        }
+        if exhausted && parked == 0 {
+            return
+        }
+        <-l.wake
+        woken = true
+    }
+}
@@ -0,0 +1,260 @@
+package mx1014
+
+import (
+    "bytes"
+    "crypto/tls"
+    "log"
+    "net"
+    "os"
+    "os/signal"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// egressRecord is what arrived from one source in the listen mode
+type egressRecord struct {
+    tcp      map[int]bool
+    udp      map[int]bool
+    verified map[string]bool // "tcp/80": verified by the token (-k)
+    profiles map[string]bool // "tls/443": completed the exchange of the profile (-pr)
+    icmp     bool            // echo requests with the token (-icmp)
+}
+
+// EgressListener is the other side of the egress test (-e/-u), it logs every
+// inbound connection or datagram and reports which ports made it out
+type EgressListener struct {
+    mutex   sync.Mutex
+    records    map[string]*egressRecord // source ip: record
+    payload    *regexp.Regexp
+    tlsConfig  *tls.Config // answers the tls profile
+    dnsQueries []dnsQuery  // the DNS egress test (-dns)
+}
+
+func NewEgressListener() *EgressListener {
+    // the whole echo data (-d) with %port% as the capture group
+    pattern := regexp.QuoteMeta(strings.TrimSpace(senddata))
+    pattern = "^" + strings.Replace(pattern, "%port%", `(\d{1,5})`, -1) + "$"
+    if !strings.Contains(senddata, "%port%") {
+        log.Printf("# The echo data (-d) has no %%port%%, the echoed ports are not recorded\n")
+    }
+    l := &EgressListener{
+        records: make(map[string]*egressRecord),
+        payload: regexp.MustCompile(pattern),
+    }
+    if config, err := selfSignedConfig(); err != nil {
+        log.Printf("# The tls profile is disabled: %s\n", err)
+    } else {
+        l.tlsConfig = config
+    }
+    return l
+}
+
+// payloadPort parses the port of the echo data, -1 if not found
+func (l *EgressListener) payloadPort(data []byte) int {
+    if strings.HasPrefix(string(data), "MX1014 ") { // a token with a wrong key
+        return -1
+    }
+    m := l.payload.FindSubmatch(bytes.TrimSpace(data))
+    if len(m) < 2 {
+        return -1
+    }
+    port, err := strconv.Atoi(string(m[1]))
+    if err != nil || port < 1 || port > 65535 {
+        return -1
+    }
+    return port
+}
+
+// recordOf returns the record of the source, the caller holds the mutex
+func (l *EgressListener) recordOf(source string) *egressRecord {
+    host := addrHost(source)
+    r := l.records[host]
+    if r == nil {
+        r = &egressRecord{tcp: make(map[int]bool), udp: make(map[int]bool), verified: make(map[string]bool), profiles: make(map[string]bool)}
+        l.records[host] = r
+    }
+    return r
+}
+
+func (l *EgressListener) record(proto string, source string, dstPort int, data []byte, tokenPort int, profile string) {
+    port := dstPort
+    echo := "-"
+    if tokenPort > 0 {
+        echo = strconv.Itoa(tokenPort) + " verified"
+        port = tokenPort
+    } else if payloadPort := l.payloadPort(data); payloadPort > 0 {
+        echo = strconv.Itoa(payloadPort)
+        port = payloadPort
+    }
+
+    l.mutex.Lock()
+    r := l.recordOf(source)
+    if proto == "tcp" {
+        r.tcp[port] = true
+    } else {
+        r.udp[port] = true
+    }
+    if tokenPort > 0 {
+        r.verified[proto+"/"+strconv.Itoa(port)] = true
+    }
+    if profile != "" {
+        r.profiles[strings.Fields(profile)[0]+"/"+strconv.Itoa(port)] = true
+        echo += ", " + profile
+    }
+    log.Printf("# %s %-21s => :%-5d (echo: %s)\n", proto, source, dstPort, echo)
+    l.mutex.Unlock()
+}
+
+func (l *EgressListener) serveTCP(listener net.Listener) {
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if verbose {
+                log.Printf("# Error: %s\n", err)
+            }
+            continue
+        }
+        go func(conn net.Conn) {
+            defer conn.Close()
+            dstPort := conn.LocalAddr().(*net.TCPAddr).Port
+            if tcpConn, ok := conn.(*net.TCPConn); ok {
+                if origPort, err := OriginalDstPort(tcpConn); err == nil {
+                    dstPort = origPort
+                }
+            }
+            conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout)))
+            buf := make([]byte, 4096)
+            n, _ := conn.Read(buf)
+            profile, data := l.answerProfile(conn, buf[:n])
+            tokenPort := -1
+            if egressKey != "" {
+                if ack, port, ok := EgressAck(data); ok {
+                    conn.Write([]byte(ack))
+                    tokenPort = port
+                }
+            }
+            l.record("tcp", conn.RemoteAddr().String(), dstPort, data, tokenPort, profile)
+        }(conn)
+    }
+}
+
+func (l *EgressListener) serveUDP(conn net.PacketConn) {
+    dstPort := conn.LocalAddr().(*net.UDPAddr).Port
+    buf := make([]byte, 65536)
+    for {
+        n, addr, err := conn.ReadFrom(buf)
+        if err != nil {
+            if verbose {
+                log.Printf("# Error: %s\n", err)
+            }
+            continue
+        }
+        tokenPort := -1
+        if egressKey != "" {
+            if ack, port, ok := EgressAck(buf[:n]); ok {
+                conn.WriteTo([]byte(ack), addr)
+                tokenPort = port
+            }
+        }
+        l.record("udp", addr.String(), dstPort, buf[:n], tokenPort, "")
+    }
+}
+
+// Report prints the ports that made it out of each source
+func (l *EgressListener) Report() {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    var hosts []string
+    for host := range l.records {
+        hosts = append(hosts, host)
+    }
+    sort.Strings(hosts)
+    log.Printf("\n# Egress report (%d sources)\n", len(hosts))
+    for _, host := range hosts {
+        r := l.records[host]
+        if r.icmp {
+            log.Printf("%-16s tcp: %s  udp: %s  icmp: yes\n", host, sortedPorts(r.tcp), sortedPorts(r.udp))
+        } else {
+            log.Printf("%-16s tcp: %s  udp: %s\n", host, sortedPorts(r.tcp), sortedPorts(r.udp))
+        }
+        if len(r.verified) > 0 {
+            log.Printf("%-16s verified: %s\n", "", sortedKeys(r.verified))
+        }
+        if len(r.profiles) > 0 {
+            log.Printf("%-16s profiles: %s\n", "", sortedKeys(r.profiles))
+        }
+    }
+}
+
+func sortedPorts(set map[int]bool) string {
+    if len(set) == 0 {
+        return "-"
+    }
+    var ports []int
+    for port := range set {
+        ports = append(ports, port)
+    }
+    sort.Ints(ports)
+    return joinPorts(ports)
+}
+
+// ListenServer binds the TCP and UDP ports, or a single port behind the
+// iptables REDIRECT (SO_ORIGINAL_DST), until interrupted
+func ListenServer(ports []string) {
+    l := NewEgressListener()
+    bound := 0
+    for _, port := range ports {
+        if isDNSPort(port) {
+            if listener, err := net.Listen("tcp", ":"+port); err != nil {
+                log.Printf("# Listen dns tcp %s failed: %s\n", port, err)
+            } else {
+                bound++
+                go l.serveDNSTCP(listener)
+            }
+            if conn, err := net.ListenPacket("udp", ":"+port); err != nil {
+                log.Printf("# Listen dns udp %s failed: %s\n", port, err)
+            } else {
+                bound++
+                go l.serveDNSUDP(conn)
+            }
+            continue
+        }
+        if listener, err := net.Listen("tcp", ":"+port); err != nil {
+            log.Printf("# Listen tcp %s failed: %s\n", port, err)
+        } else {
+            bound++
+            go l.serveTCP(listener)
+        }
+        if conn, err := net.ListenPacket("udp", ":"+port); err != nil {
+            log.Printf("# Listen udp %s failed: %s\n", port, err)
+        } else {
+            bound++
+            go l.serveUDP(conn)
+        }
+    }
+    if icmpMode {
+        if conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0"); err != nil {
+            log.Printf("# Listen icmp failed: %s\n", err)
+        } else {
+            bound++
+            go l.serveICMP(conn)
+        }
+    }
+    if bound == 0 {
+        ErrPrint("No port is listening")
+    }
+    log.Printf("# %s Listening on %d tcp/udp sockets (%d ports)...\n\n", startTime.Format("2006/01/02 15:04:05"), bound, len(ports))
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+    <-signals
+    l.Report()
+    if dnsDomain != "" {
+        l.DNSReport()
+    }
+}
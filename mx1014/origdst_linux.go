@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package mx1014
+
+import (
+    "net"
+    "syscall"
+)
+
+const soOriginalDst = 80 // SO_ORIGINAL_DST of linux/netfilter_ipv4.h
+
+// OriginalDstPort returns the destination port before the iptables REDIRECT
+func OriginalDstPort(conn *net.TCPConn) (int, error) {
+    rawConn, err := conn.SyscallConn()
+    if err != nil {
+        return 0, err
+    }
+    var port int
+    var sockErr error
+    err = rawConn.Control(func(fd uintptr) {
+        // struct sockaddr_in fits in the ipv6_mreq, port at [2:4]
+        mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+        if err != nil {
+            sockErr = err
+            return
+        }
+        port = int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3])
+    })
+    if err != nil {
+        return 0, err
+    }
+    return port, sockErr
+}
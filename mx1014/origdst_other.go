@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package mx1014
+
+import (
+    "errors"
+    "net"
+)
+
+// OriginalDstPort is only supported on linux
+func OriginalDstPort(conn *net.TCPConn) (int, error) {
+    return 0, errors.New("SO_ORIGINAL_DST is not supported")
+}
@@ -0,0 +1,282 @@
+package mx1014
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Port expression:
+//   in,8000-8100       union
+//   in,!445            negation, removed from the whole result
+//   web2-web1          difference
+//   rce&web2           intersection
+//   top:100            the most commonly open ports (see portRanking)
+//   1-1024:2           range with step, -100 and 60000- are open ranges
+
+// PortExprError is a parse error with the position in the expression
+type PortExprError struct {
+    Expr string
+    Pos  int
+    Msg  string
+}
+
+func (e *PortExprError) Error() string {
+    return fmt.Sprintf("%s at position %d: %s\n    %s\n    %s^", e.Msg, e.Pos+1, e.Expr, e.Expr, strings.Repeat(" ", e.Pos))
+}
+
+const (
+    tokenEnd = iota
+    tokenNumber
+    tokenName
+    tokenOp // , ! & - :
+)
+
+type portToken struct {
+    kind int
+    text string
+    pos  int
+}
+
+type portExprParser struct {
+    expr   string
+    tokens []portToken
+    i      int
+}
+
+// portSet keeps the order of the ports that are added
+type portSet struct {
+    order []int
+    has   map[int]bool
+}
+
+func newPortSet() *portSet {
+    return &portSet{has: make(map[int]bool)}
+}
+
+func (s *portSet) add(port int) {
+    if !s.has[port] {
+        s.has[port] = true
+        s.order = append(s.order, port)
+    }
+}
+
+func (s *portSet) union(o *portSet) {
+    for _, port := range o.order {
+        s.add(port)
+    }
+}
+
+func (s *portSet) filter(o *portSet, keep bool) *portSet {
+    result := newPortSet()
+    for _, port := range s.order {
+        if o.has[port] == keep {
+            result.add(port)
+        }
+    }
+    return result
+}
+
+func (p *portExprParser) errorf(pos int, format string, args ...interface{}) error {
+    return &PortExprError{Expr: p.expr, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *portExprParser) tokenize() error {
+    expr := p.expr
+    for i := 0; i < len(expr); {
+        c := expr[i]
+        switch {
+        case c == ' ':
+            i++
+        case c >= '0' && c <= '9':
+            j := i
+            for j < len(expr) && expr[j] >= '0' && expr[j] <= '9' {
+                j++
+            }
+            p.tokens = append(p.tokens, portToken{tokenNumber, expr[i:j], i})
+            i = j
+        case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+            j := i
+            for j < len(expr) && (expr[j] == '_' || (expr[j] >= 'a' && expr[j] <= 'z') ||
+                (expr[j] >= 'A' && expr[j] <= 'Z') || (expr[j] >= '0' && expr[j] <= '9')) {
+                j++
+            }
+            p.tokens = append(p.tokens, portToken{tokenName, expr[i:j], i})
+            i = j
+        case strings.IndexByte(",!&-:", c) >= 0:
+            p.tokens = append(p.tokens, portToken{tokenOp, string(c), i})
+            i++
+        default:
+            return p.errorf(i, "unexpected character %q", c)
+        }
+    }
+    p.tokens = append(p.tokens, portToken{tokenEnd, "", len(expr)})
+    return nil
+}
+
+func (p *portExprParser) peek() portToken {
+    return p.tokens[p.i]
+}
+
+func (p *portExprParser) next() portToken {
+    token := p.tokens[p.i]
+    if token.kind != tokenEnd {
+        p.i++
+    }
+    return token
+}
+
+func (p *portExprParser) isOp(op string) bool {
+    token := p.peek()
+    return token.kind == tokenOp && token.text == op
+}
+
+func (p *portExprParser) number(token portToken) (int, error) {
+    n, err := strconv.Atoi(token.text)
+    if err != nil || n < 1 || n > 65535 {
+        return 0, p.errorf(token.pos, "wrong port number %s (1-65535)", token.text)
+    }
+    return n, nil
+}
+
+// expr := ['!'] term {',' ['!'] term}
+func (p *portExprParser) parseExpr() (*portSet, error) {
+    result, negative := newPortSet(), newPortSet()
+    for {
+        negate := false
+        if p.isOp("!") {
+            p.next()
+            negate = true
+        }
+        set, err := p.parseTerm()
+        if err != nil {
+            return nil, err
+        }
+        if negate {
+            negative.union(set)
+        } else {
+            result.union(set)
+        }
+        token := p.next()
+        if token.kind == tokenEnd {
+            break
+        }
+        if token.kind != tokenOp || token.text != "," {
+            return nil, p.errorf(token.pos, "unexpected %q, expect \",\"", token.text)
+        }
+    }
+    return result.filter(negative, false), nil
+}
+
+// term := operand {('&' | '-') operand}
+func (p *portExprParser) parseTerm() (*portSet, error) {
+    set, err := p.parseOperand()
+    if err != nil {
+        return nil, err
+    }
+    for p.isOp("&") || p.isOp("-") {
+        op := p.next()
+        right, err := p.parseOperand()
+        if err != nil {
+            return nil, err
+        }
+        set = set.filter(right, op.text == "&")
+    }
+    return set, nil
+}
+
+// operand := group | top:N | range
+func (p *portExprParser) parseOperand() (*portSet, error) {
+    token := p.peek()
+    set := newPortSet()
+    switch {
+    case token.kind == tokenName && token.text == "top":
+        p.next()
+        if !p.isOp(":") {
+            return nil, p.errorf(p.peek().pos, "expect \":\" after top, e.g. top:100")
+        }
+        p.next()
+        countToken := p.next()
+        if countToken.kind != tokenNumber {
+            return nil, p.errorf(countToken.pos, "expect the number of top ports")
+        }
+        count, _ := strconv.Atoi(countToken.text)
+        for _, port := range TopPorts(count) {
+            set.add(port)
+        }
+    case token.kind == tokenName:
+        p.next()
+        ports, ok := portGroup[token.text]
+        if !ok {
+            return nil, p.errorf(token.pos, "unknown port group %q", token.text)
+        }
+        for _, port := range ports {
+            set.add(port)
+        }
+    case token.kind == tokenNumber || (token.kind == tokenOp && token.text == "-"):
+        return p.parseRange()
+    default:
+        return nil, p.errorf(token.pos, "expect a port, range or port group")
+    }
+    return set, nil
+}
+
+// range := N | [N] '-' [N] [':' step]
+func (p *portExprParser) parseRange() (*portSet, error) {
+    var err error
+    startPort, endPort := 1, 65535
+    token := p.peek()
+    isRange := true
+    if token.kind == tokenNumber {
+        p.next()
+        if startPort, err = p.number(token); err != nil {
+            return nil, err
+        }
+        // a single port, or the difference such as "8080-web1"
+        isRange = p.isOp("-") && p.tokens[p.i+1].kind != tokenName
+        if !isRange {
+            endPort = startPort
+        }
+    }
+    if isRange {
+        p.next() // '-'
+        if end := p.peek(); end.kind == tokenNumber {
+            p.next()
+            if endPort, err = p.number(end); err != nil {
+                return nil, err
+            }
+        }
+        if startPort > endPort {
+            return nil, p.errorf(token.pos, "wrong port range %d-%d", startPort, endPort)
+        }
+    }
+    step := 1
+    if p.isOp(":") {
+        p.next()
+        stepToken := p.next()
+        if stepToken.kind != tokenNumber {
+            return nil, p.errorf(stepToken.pos, "expect the step of the port range")
+        }
+        if step, _ = strconv.Atoi(stepToken.text); step < 1 {
+            return nil, p.errorf(stepToken.pos, "wrong step %s", stepToken.text)
+        }
+    }
+    set := newPortSet()
+    for port := startPort; port <= endPort; port += step {
+        set.add(port)
+    }
+    return set, nil
+}
+
+// ParsePortExpr parses the port expression, see the top of this file
+func ParsePortExpr(expr string) ([]int, error) {
+    p := &portExprParser{expr: expr}
+    if err := p.tokenize(); err != nil {
+        return nil, err
+    }
+    set, err := p.parseExpr()
+    if err != nil {
+        return nil, err
+    }
+    return set.order, nil
+}
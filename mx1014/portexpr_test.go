@@ -0,0 +1,77 @@
+package mx1014
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParsePortExpr(t *testing.T) {
+    portGroup["test_web"] = []int{80, 443, 8080}
+    portGroup["test_tls"] = []int{443, 8443}
+    defer delete(portGroup, "test_web")
+    defer delete(portGroup, "test_tls")
+
+    tests := []struct {
+        expr  string
+        ports []int
+    }{
+        {"80", []int{80}},
+        {"22,80,22", []int{22, 80}},
+        {"1-5", []int{1, 2, 3, 4, 5}},
+        {"1-10:3", []int{1, 4, 7, 10}},
+        {"-3", []int{1, 2, 3}},
+        {"65533-", []int{65533, 65534, 65535}},
+        {"1-5,!3", []int{1, 2, 4, 5}},
+        {"!3,1-5", []int{1, 2, 4, 5}},
+        {"test_web", []int{80, 443, 8080}},
+        {"test_web-test_tls", []int{80, 8080}},
+        {"test_web&test_tls", []int{443}},
+        {"test_web,test_tls", []int{80, 443, 8080, 8443}},
+        {"8080-test_web", nil},
+        {"test_web,!443", []int{80, 8080}},
+        {" 80 , 443 ", []int{80, 443}},
+    }
+    for _, test := range tests {
+        ports, err := ParsePortExpr(test.expr)
+        if err != nil {
+            t.Errorf("ParsePortExpr(%q) error: %v", test.expr, err)
+            continue
+        }
+        if len(ports) == 0 && len(test.ports) == 0 {
+            continue
+        }
+        if !reflect.DeepEqual(ports, test.ports) {
+            t.Errorf("ParsePortExpr(%q) = %v, expect %v", test.expr, ports, test.ports)
+        }
+    }
+}
+
+func TestParsePortExprError(t *testing.T) {
+    tests := []struct {
+        expr string
+        pos  int
+    }{
+        {"0", 0},
+        {"65536", 0},
+        {"100-10", 0},
+        {"1-10:0", 5},
+        {"80,", 3},
+        {"80,,443", 3},
+        {"no_such_group", 0},
+        {"top", 3},
+        {"top:x", 4},
+        {"80;443", 2},
+        {"80 443", 3},
+    }
+    for _, test := range tests {
+        _, err := ParsePortExpr(test.expr)
+        exprErr, ok := err.(*PortExprError)
+        if !ok {
+            t.Errorf("ParsePortExpr(%q) error = %v, expect a PortExprError", test.expr, err)
+            continue
+        }
+        if exprErr.Pos != test.pos {
+            t.Errorf("ParsePortExpr(%q) error at %d, expect %d: %v", test.expr, exprErr.Pos, test.pos, err)
+        }
+    }
+}
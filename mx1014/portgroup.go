@@ -0,0 +1,325 @@
+package mx1014
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// PortGroupDefs are the unresolved port groups, e.g. jboss: "jboss_rmi,80,8000-8010"
+type PortGroupDefs struct {
+    Names []string          // in the order of definition
+    Specs map[string]string // name: spec
+}
+
+var (
+    portGroupLineRegexp  = regexp.MustCompile(`^\s*"?([A-Za-z0-9_]+)"?\s*:\s*"([^"]*)"`)
+    portGroupBlockRegexp = regexp.MustCompile("(?s)## Port Group\n.*?```ruby\n(.*?)```")
+)
+
+func (d *PortGroupDefs) add(name string, spec string) {
+    if _, ok := d.Specs[name]; !ok {
+        d.Names = append(d.Names, name)
+    }
+    d.Specs[name] = spec
+}
+
+// Children returns the groups that are referenced by each group
+func (d *PortGroupDefs) Children() map[string][]string {
+    children := make(map[string][]string)
+    for _, name := range d.Names {
+        for _, item := range strings.Split(d.Specs[name], ",") {
+            item = strings.TrimSpace(item)
+            if item != "" && strings.Trim(item, "0123456789-") != "" {
+                children[name] = append(children[name], item)
+            }
+        }
+    }
+    return children
+}
+
+// ParsePortGroupDefs parses JSON ({"name": "80,web1"} or {"name": [80, "8000-8010", "web1"]}),
+// or the nested format of the README ("name: "80,web1",", the README itself is accepted)
+func ParsePortGroupDefs(data []byte) (*PortGroupDefs, error) {
+    defs := &PortGroupDefs{Specs: make(map[string]string)}
+    if m := portGroupBlockRegexp.FindSubmatch(data); m != nil {
+        data = m[1]
+    }
+
+    if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+        var groups map[string]interface{}
+        if err := json.Unmarshal(trimmed, &groups); err == nil {
+            var names []string
+            for name := range groups {
+                names = append(names, name)
+            }
+            sort.Strings(names)
+            for _, name := range names {
+                spec, err := jsonPortSpec(groups[name])
+                if err != nil {
+                    return nil, fmt.Errorf("port group %q: %s", name, err)
+                }
+                defs.add(name, spec)
+            }
+            return defs, nil
+        }
+    }
+
+    for i, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || line[0] == 0x23 || line == "{" || line == "}" { // 0x23 == #
+            continue
+        }
+        m := portGroupLineRegexp.FindStringSubmatch(line)
+        if m == nil {
+            return nil, fmt.Errorf("line %d: wrong port group definition: %s", i+1, line)
+        }
+        defs.add(m[1], m[2])
+    }
+    if len(defs.Names) == 0 {
+        return nil, fmt.Errorf("no port group found")
+    }
+    return defs, nil
+}
+
+func jsonPortSpec(value interface{}) (string, error) {
+    switch v := value.(type) {
+    case string:
+        return v, nil
+    case float64:
+        return strconv.Itoa(int(v)), nil
+    case []interface{}:
+        var items []string
+        for _, item := range v {
+            spec, err := jsonPortSpec(item)
+            if err != nil {
+                return "", err
+            }
+            items = append(items, spec)
+        }
+        return strings.Join(items, ","), nil
+    }
+    return "", fmt.Errorf("wrong value %v", value)
+}
+
+// ResolvePortGroups expands the nested references and the ranges of the port
+// groups, a name that is not defined falls back to the base groups
+func ResolvePortGroups(defs *PortGroupDefs, base map[string][]int) (map[string][]int, error) {
+    groups := make(map[string][]int)
+    resolving := make(map[string]bool)
+
+    var resolve func(name string) ([]int, error)
+    resolve = func(name string) ([]int, error) {
+        if ports, ok := groups[name]; ok {
+            return ports, nil
+        }
+        spec, ok := defs.Specs[name]
+        if !ok {
+            if ports, ok := base[name]; ok {
+                return ports, nil
+            }
+            return nil, fmt.Errorf("unknown port group %q", name)
+        }
+        if resolving[name] {
+            return nil, fmt.Errorf("port group %q references itself", name)
+        }
+        resolving[name] = true
+
+        set := make(map[int]bool)
+        for _, item := range strings.Split(spec, ",") {
+            item = strings.TrimSpace(item)
+            if item == "" {
+                continue
+            }
+            ports, err := resolveItem(item, resolve)
+            if err != nil {
+                return nil, fmt.Errorf("port group %q: %s", name, err)
+            }
+            for _, port := range ports {
+                set[port] = true
+            }
+        }
+        var ports []int
+        for port := range set {
+            ports = append(ports, port)
+        }
+        sort.Ints(ports)
+
+        delete(resolving, name)
+        groups[name] = ports
+        return ports, nil
+    }
+
+    for _, name := range defs.Names {
+        if _, err := resolve(name); err != nil {
+            return nil, err
+        }
+    }
+    return groups, nil
+}
+
+// resolveItem: a port, a range "a-b" or a group name
+func resolveItem(item string, resolve func(name string) ([]int, error)) ([]int, error) {
+    if strings.Trim(item, "0123456789-") != "" {
+        return resolve(item)
+    }
+    a := strings.Split(item, "-")
+    if len(a) > 2 {
+        return nil, fmt.Errorf("wrong port range %q", item)
+    }
+    startPort, err := strconv.Atoi(a[0])
+    if err != nil || startPort < 1 || startPort > 65535 {
+        return nil, fmt.Errorf("wrong port %q", item)
+    }
+    endPort := startPort
+    if len(a) == 2 {
+        endPort, err = strconv.Atoi(a[1])
+        if err != nil || endPort < startPort || endPort > 65535 {
+            return nil, fmt.Errorf("wrong port range %q", item)
+        }
+    }
+    var ports []int
+    for port := startPort; port <= endPort; port++ {
+        ports = append(ports, port)
+    }
+    return ports, nil
+}
+
+// LoadPortGroups loads the port groups file, merged into or overriding the built-in groups.
+// A merged group also updates the built-in groups that reference it
+func LoadPortGroups(file string, override bool) error {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return err
+    }
+    defs, err := ParsePortGroupDefs(data)
+    if err != nil {
+        return err
+    }
+    base := portGroup
+    if override {
+        base = nil
+    }
+    groups, err := ResolvePortGroups(defs, base)
+    if err != nil {
+        return err
+    }
+    if override {
+        portGroup = groups
+        portGroupChildren = defs.Children()
+    } else {
+        parents := builtinParents(defs)
+        children := defs.Children()
+        for name, ports := range groups {
+            portGroup[name] = ports
+            portGroupChildren[name] = children[name]
+        }
+        groups, err := ResolvePortGroups(parents, portGroup)
+        if err != nil {
+            return err
+        }
+        for name, ports := range groups {
+            portGroup[name] = ports
+        }
+    }
+    return nil
+}
+
+// builtinParents returns the built-in groups that reference the groups of defs
+// (directly or through other groups) and are not defined in defs, e.g. rce and
+// in for jboss, to be resolved again after the merge. Their own ports are the
+// ones that none of their children contain, so a port that a group lists itself
+// and also gets from a child follows the child
+func builtinParents(defs *PortGroupDefs) *PortGroupDefs {
+    affected := make(map[string]bool)
+    for name := range defs.Specs {
+        affected[name] = true
+    }
+    for changed := true; changed; {
+        changed = false
+        for name, children := range portGroupChildren {
+            if affected[name] {
+                continue
+            }
+            for _, child := range children {
+                if affected[child] {
+                    affected[name] = true
+                    changed = true
+                    break
+                }
+            }
+        }
+    }
+
+    var names []string
+    for name := range affected {
+        if _, ok := defs.Specs[name]; !ok {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    parents := &PortGroupDefs{Specs: make(map[string]string)}
+    for _, name := range names {
+        inChild := make(map[int]bool)
+        for _, child := range portGroupChildren[name] {
+            for _, port := range portGroup[child] {
+                inChild[port] = true
+            }
+        }
+        items := append([]string(nil), portGroupChildren[name]...)
+        for _, port := range portGroup[name] {
+            if !inChild[port] {
+                items = append(items, strconv.Itoa(port))
+            }
+        }
+        parents.add(name, strings.Join(items, ","))
+    }
+    return parents
+}
+
+// specificGroups returns the groups of the port without the ones that only
+// contain it through a child group, e.g. 8083 => jboss_rmi (not jboss, rce, in)
+func specificGroups(groups []string) []string {
+    contains := make(map[string]bool)
+    for _, name := range groups {
+        contains[name] = true
+    }
+    var specific []string
+    for _, name := range groups {
+        viaChild := false
+        for _, child := range portGroupChildren[name] {
+            if contains[child] {
+                viaChild = true
+                break
+            }
+        }
+        if !viaChild {
+            specific = append(specific, name)
+        }
+    }
+    return specific
+}
+
+// buildPortGroupMap builds the reverse lookup of portGroup: port: group names,
+// and the port labels of the output (the most specific groups, or all with -G)
+func buildPortGroupMap() {
+    portGroupMap = make(map[int][]string)
+    portServersMap = make(map[string]string)
+    for name, ports := range portGroup {
+        for _, port := range ports {
+            portGroupMap[port] = append(portGroupMap[port], name)
+        }
+    }
+    for port, servers := range portGroupMap {
+        sort.Strings(servers)
+        if !fullPortGroup {
+            servers = specificGroups(servers)
+        }
+        portServersMap[strconv.Itoa(port)] = strings.Join(servers, ",")
+    }
+}
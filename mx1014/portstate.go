@@ -0,0 +1,135 @@
+package mx1014
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "strings"
+    "sync/atomic"
+    "syscall"
+)
+
+// PortState is the result of a TCP connect (TcpConnect, ProxyTcpConnect, -epoll)
+type PortState int
+
+const (
+    StateOpen      PortState = 0
+    StateClosed    PortState = 1
+    StateFiltered  PortState = 2
+    StateNoRoute   PortState = 3
+    StateDenied    PortState = 4
+    StateDown      PortState = 5
+    StateErrorHost PortState = 6
+    StateVerified  PortState = 7
+    StateNoPort    PortState = 8 // no ephemeral port (EADDRNOTAVAIL)
+    StateProxyErr  PortState = 9  // the proxy failed, not the target (-px)
+    StateProxyDeny PortState = 10 // the proxy refused the CONNECT (403...), nothing about the target
+    StateProxyAuth PortState = 11 // the proxy requires authentication (407)
+    StateUnknown   PortState = -1
+    StateAbort     PortState = -2 // too many open files
+)
+
+// the states in the order of the summary
+var portStates = []PortState{StateOpen, StateVerified, StateClosed, StateFiltered, StateNoRoute, StateDenied, StateDown, StateErrorHost, StateNoPort, StateProxyErr, StateProxyDeny, StateProxyAuth, StateAbort, StateUnknown}
+
+var stateNames = map[PortState]string{
+    StateOpen:      "open",
+    StateClosed:    "closed",
+    StateFiltered:  "filtered",
+    StateNoRoute:   "noroute",
+    StateDenied:    "denied",
+    StateDown:      "down",
+    StateErrorHost: "error_host",
+    StateVerified:  "verified",
+    StateNoPort:    "no_port",
+    StateProxyErr:  "proxy_error",
+    StateProxyDeny: "proxy_denied",
+    StateProxyAuth: "proxy_auth",
+    StateUnknown:   "unknown",
+    StateAbort:     "abort",
+}
+
+func (s PortState) String() string {
+    if name, ok := stateNames[s]; ok {
+        return name
+    }
+    return fmt.Sprintf("state(%d)", int(s))
+}
+
+// connectErrno unwraps net.OpError and os.SyscallError to the errno
+// (no errors.Is, it needs go 1.13)
+func connectErrno(err error) (syscall.Errno, bool) {
+    if opErr, ok := err.(*net.OpError); ok {
+        err = opErr.Err
+    }
+    if sysErr, ok := err.(*os.SyscallError); ok {
+        err = sysErr.Err
+    }
+    errno, ok := err.(syscall.Errno)
+    return errno, ok
+}
+
+// ClassifyConnectError returns the state of the connect error, by errno when
+// there is one (errnoStates, POSIX or WinSock), otherwise by the error message
+func ClassifyConnectError(targetAddr string, err error) PortState {
+    if errno, ok := connectErrno(err); ok {
+        if state, ok := errnoStates[errno]; ok {
+            return state
+        }
+    }
+    if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+        return StateFiltered
+    }
+
+    errMsg := err.Error()
+    if strings.Contains(errMsg, "refused") {
+        return StateClosed
+    } else if strings.Contains(errMsg, "An attempt was made to access a socket in a way forbidden by its access permissions.") {
+        return StateClosed
+    } else if strings.Contains(errMsg, "timeout") {
+        return StateFiltered
+    } else if strings.Contains(errMsg, "protocol not available") {
+        return StateFiltered
+    } else if strings.Contains(errMsg, "no route to host") {
+        return StateNoRoute
+    } else if strings.Contains(errMsg, "permission denied") {
+        return StateDenied
+    } else if strings.Contains(errMsg, "host is down") {
+        return StateDown
+    } else if strings.Contains(errMsg, "no such host") {
+        return StateErrorHost
+    } else if strings.Contains(errMsg, "network is unreachable") {
+        return StateErrorHost
+    } else if strings.Contains(errMsg, "The requested address is not valid in its context.") {
+        return StateErrorHost
+    } else if strings.Contains(errMsg, "A socket operation was attempted to an unreachable") {
+        return StateErrorHost
+    } else if strings.Contains(errMsg, "cannot assign requested address") {
+        return StateNoPort
+    } else if strings.Contains(errMsg, "too many open files") {
+        return StateAbort
+    } else {
+        log.Printf("# [Unkown!!!] %s => %s", targetAddr, err)
+        return StateUnknown
+    }
+}
+
+// stateCounts counts the states of the scan, index: state - StateAbort
+var stateCounts [14]int64
+
+func CountState(state PortState) {
+    if state < StateAbort || state > StateProxyAuth {
+        state = StateUnknown
+    }
+    atomic.AddInt64(&stateCounts[state-StateAbort], 1)
+}
+
+// StateSummary returns the count of each state, e.g. "open 3, closed 1021, ..., unknown 0"
+func StateSummary() string {
+    var parts []string
+    for _, state := range portStates {
+        parts = append(parts, fmt.Sprintf("%s %d", state, atomic.LoadInt64(&stateCounts[state-StateAbort])))
+    }
+    return strings.Join(parts, ", ")
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package mx1014
+
+import (
+    "syscall"
+)
+
+// errnoStates classifies the connect errors by errno, the same on every
+// language and platform that reports the POSIX errno
+var errnoStates = map[syscall.Errno]PortState{
+    syscall.ECONNREFUSED:  StateClosed,
+    syscall.ETIMEDOUT:     StateFiltered,
+    syscall.ENOPROTOOPT:   StateFiltered,
+    syscall.EHOSTUNREACH:  StateNoRoute,
+    syscall.EACCES:        StateDenied,
+    syscall.EPERM:         StateDenied,
+    syscall.EHOSTDOWN:     StateDown,
+    syscall.ENETUNREACH:   StateErrorHost,
+    syscall.EADDRNOTAVAIL: StateNoPort,
+    syscall.EMFILE:        StateAbort,
+    syscall.ENFILE:        StateAbort,
+}
@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package mx1014
+
+import (
+    "syscall"
+)
+
+// errnoStates classifies the connect errors by the WinSock error code, the
+// syscall.E* constants of windows are not what connect returns
+var errnoStates = map[syscall.Errno]PortState{
+    10061: StateClosed,    // WSAECONNREFUSED
+    10013: StateClosed,    // WSAEACCES, the windows firewall blocks the port (as the message before)
+    10060: StateFiltered,  // WSAETIMEDOUT
+    10042: StateFiltered,  // WSAENOPROTOOPT
+    10065: StateNoRoute,   // WSAEHOSTUNREACH
+    10064: StateDown,      // WSAEHOSTDOWN
+    10051: StateErrorHost, // WSAENETUNREACH
+    10050: StateErrorHost, // WSAENETDOWN
+    10049: StateErrorHost, // WSAEADDRNOTAVAIL, not a valid destination on windows
+    10055: StateNoPort,    // WSAENOBUFS, no ephemeral port
+    10024: StateAbort,     // WSAEMFILE
+}
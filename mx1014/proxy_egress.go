@@ -0,0 +1,203 @@
+package mx1014
+
+import (
+    "bufio"
+    "encoding/base64"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// Proxy egress test (-px), the ports are tested by CONNECT through the proxy of
+// -proxy, the environment (HTTPS_PROXY, HTTP_PROXY, ALL_PROXY) or the PAC file (-pac)
+
+var (
+    proxyURL          *url.URL
+    proxyAuthRequired bool
+    pacProxyRegexp    = regexp.MustCompile(`PROXY\s+([^\s;"']+)`)
+)
+
+// DiscoverProxy returns the proxy and where it was found
+func DiscoverProxy(proxy string, pac string) (*url.URL, string, error) {
+    source := "-proxy"
+    if proxy == "" {
+        for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "ALL_PROXY", "all_proxy"} {
+            if proxy = os.Getenv(name); proxy != "" {
+                source = name
+                break
+            }
+        }
+    }
+    if proxy == "" && pac != "" {
+        data, err := readPAC(pac)
+        if err != nil {
+            return nil, "", fmt.Errorf("PAC file %s: %s", pac, err)
+        }
+        m := pacProxyRegexp.FindSubmatch(data)
+        if m == nil {
+            return nil, "", fmt.Errorf("no PROXY in the PAC file %s", pac)
+        }
+        proxy, source = string(m[1]), pac
+    }
+    if proxy == "" {
+        return nil, "", fmt.Errorf("no proxy found (HTTP_PROXY/HTTPS_PROXY, -proxy or -pac)")
+    }
+    if !strings.Contains(proxy, "://") {
+        proxy = "http://" + proxy
+    }
+    u, err := url.Parse(proxy)
+    if err != nil || u.Host == "" {
+        return nil, "", fmt.Errorf("wrong proxy %q", proxy)
+    }
+    if u.Scheme != "http" {
+        return nil, "", fmt.Errorf("only the HTTP proxy is supported: %s", proxy)
+    }
+    if u.Port() == "" {
+        u.Host += ":80"
+    }
+    return u, source, nil
+}
+
+func readPAC(pac string) ([]byte, error) {
+    if strings.HasPrefix(pac, "http://") || strings.HasPrefix(pac, "https://") {
+        client := http.Client{Timeout: time.Second * 10}
+        resp, err := client.Get(pac)
+        if err != nil {
+            return nil, err
+        }
+        defer resp.Body.Close()
+        return ioutil.ReadAll(resp.Body)
+    }
+    return ioutil.ReadFile(pac)
+}
+
+// proxyError is a failure of the proxy itself, not an answer about the target
+type proxyError struct {
+    err error
+}
+
+func (e *proxyError) Error() string {
+    return "proxy " + proxyURL.Host + ": " + e.err.Error()
+}
+
+// proxyConnect sends CONNECT, returns the status code, the Proxy-Authenticate header and the tunnel.
+// The error is a *proxyError unless the proxy accepted the CONNECT and timed out on the target
+func proxyConnect(targetAddr string, withAuth bool) (int, string, net.Conn, error) {
+    conn, err := net.DialTimeout("tcp", proxyURL.Host, time.Millisecond*time.Duration(timeout))
+    if err != nil {
+        return 0, "", nil, &proxyError{err}
+    }
+    conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout) * 2))
+    request := "CONNECT " + targetAddr + " HTTP/1.1\r\nHost: " + targetAddr + "\r\n"
+    if withAuth && proxyURL.User != nil {
+        password, _ := proxyURL.User.Password()
+        auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+        request += "Proxy-Authorization: Basic " + auth + "\r\n"
+    }
+    if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+        conn.Close()
+        return 0, "", nil, &proxyError{err}
+    }
+    // the tunnel starts right after the response, its bytes read ahead stay in the reader
+    reader := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+    if err != nil {
+        conn.Close()
+        if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+            return 0, "", nil, err // still connecting to the target
+        }
+        return 0, "", nil, &proxyError{err}
+    }
+    conn.SetDeadline(time.Time{})
+    return resp.StatusCode, resp.Header.Get("Proxy-Authenticate"), &tunnelConn{conn, reader}, nil
+}
+
+// tunnelConn reads the tunnel through the reader of the CONNECT response
+type tunnelConn struct {
+    net.Conn
+    reader *bufio.Reader
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+    return c.reader.Read(b)
+}
+
+// CheckProxy tests whether the proxy requires authentication, and the credentials of the proxy URL
+func CheckProxy(targetAddr string) {
+    status, authenticate, conn, err := proxyConnect(targetAddr, false)
+    if err != nil {
+        ErrPrint(fmt.Sprintf("Proxy %s failed: %s", proxyURL.Host, err))
+    }
+    conn.Close()
+    if status != http.StatusProxyAuthRequired {
+        log.Printf("# proxy auth: not required\n")
+        return
+    }
+    proxyAuthRequired = true
+    if proxyURL.User == nil {
+        log.Printf("# proxy auth: required (%s), no credentials in the proxy URL\n", authenticate)
+        return
+    }
+    status, _, conn, err = proxyConnect(targetAddr, true)
+    if err == nil {
+        conn.Close()
+    }
+    if status == http.StatusProxyAuthRequired {
+        log.Printf("# proxy auth: required (%s), the credentials are rejected\n", authenticate)
+    } else {
+        log.Printf("# proxy auth: required (%s), the credentials are accepted\n", authenticate)
+    }
+}
+
+// ProxyTcpConnect is TcpConnect through the proxy, the states are the same:
+// 200: open, 504 and no response: filtered, the other 5xx (502...): closed.
+// A failure of the proxy itself (refused, reset, closed) is StateProxyErr, its
+// refusal of the CONNECT is StateProxyAuth (407) or StateProxyDeny (403...),
+// they say nothing about the target
+func ProxyTcpConnect(targetAddr string) PortState {
+    status, _, conn, err := proxyConnect(targetAddr, true)
+    if err != nil {
+        if verbose {
+            log.Printf("# Error: %s => %s (proxy)\n", targetAddr, err)
+        }
+        if _, ok := err.(*proxyError); ok {
+            return StateProxyErr
+        }
+        return StateFiltered
+    }
+    defer conn.Close()
+    switch {
+    case status == http.StatusOK:
+    case status == http.StatusGatewayTimeout:
+        return StateFiltered
+    case status >= 500: // refused or no route, reported by the proxy
+        if verbose {
+            log.Printf("# proxy %d: %s\n", status, targetAddr)
+        }
+        return StateClosed
+    case status == http.StatusProxyAuthRequired:
+        return StateProxyAuth
+    default:
+        if verbose {
+            log.Printf("# proxy denied %d: %s\n", status, targetAddr)
+        }
+        return StateProxyDeny
+    }
+
+    port := addrPort(targetAddr)
+    if egressKey != "" {
+        if VerifyEgress(conn, port) {
+            return StateVerified
+        }
+    } else if echoMode {
+        conn.Write([]byte(echoData(port)))
+    }
+    return StateOpen
+}
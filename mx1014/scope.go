@@ -0,0 +1,158 @@
+package mx1014
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "strings"
+)
+
+// Scope is the authorized scope of the engagement: CIDRs (or ranges) and domains.
+// A hostname is in the scope when it is (a subdomain of) a scope domain, or when
+// all of its addresses are in the scope. With -scope-strict the scope domains
+// must resolve into the scope too, the name may point to a third party
+type Scope struct {
+    addrs   *HostMatcher
+    nets6   []*net.IPNet // IPv6 CIDRs and addresses, for -6
+    domains []string
+    refused *HostMatcher // out-of-scope hosts, for the log
+}
+
+// targetScope is nil unless -scope is set
+var targetScope *Scope
+
+func LoadScope(file string) (*Scope, error) {
+    var addrTargets []string
+    s := &Scope{refused: &HostMatcher{names: make(map[string]bool)}}
+    for _, line := range FileReadlines(file) {
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
+        }
+        entry := strings.ToLower(fields[0])
+        if strings.Contains(entry, ":") {
+            if !strings.Contains(entry, "/") {
+                entry += "/128"
+            }
+            _, ipnet, err := net.ParseCIDR(entry)
+            if err != nil {
+                return nil, err
+            }
+            s.nets6 = append(s.nets6, ipnet)
+        } else if strings.Trim(entry, "0123456789./-") == "" {
+            // 10.0.0.1, 10.0.0.0/24, 10.0.0.5-10.0.0.9 or 10.0.0.5-9
+            addrTargets = append(addrTargets, entry)
+        } else {
+            // example.com also allows its subdomains
+            s.domains = append(s.domains, strings.TrimLeft(entry, "*."))
+        }
+    }
+    addrs, err := NewHostMatcher(addrTargets)
+    if err != nil {
+        return nil, err
+    }
+    s.addrs = addrs
+    return s, nil
+}
+
+func (s *Scope) allowDomain(host string) bool {
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+    for _, domain := range s.domains {
+        if host == domain || strings.HasSuffix(host, "."+domain) {
+            return true
+        }
+    }
+    return false
+}
+
+func (s *Scope) AllowAddr(ip net.IP) bool {
+    if ip4 := ip.To4(); ip4 != nil {
+        return s.addrs.ContainsAddr(IPToUint32(ip4))
+    }
+    for _, ipnet := range s.nets6 {
+        if ipnet.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// AllowHost allows a hostname of the scope domains, or whose resolved addresses
+// are all in the scope. With -scope-strict only the addresses count
+func (s *Scope) AllowHost(host string) bool {
+    if ip := net.ParseIP(host); ip != nil {
+        return s.AllowAddr(ip)
+    }
+    inDomain := s.allowDomain(host)
+    if inDomain && !scopeStrict {
+        return true
+    }
+    addrs, err := net.LookupHost(host)
+    if err != nil || len(addrs) == 0 {
+        return false
+    }
+    for _, addr := range addrs {
+        if ip := net.ParseIP(addr); ip == nil || !s.AllowAddr(ip) {
+            if inDomain {
+                log.Printf("# %s of the scope domains resolves out of the scope: %s (-scope-strict)\n", host, addr)
+            }
+            return false
+        }
+    }
+    return true
+}
+
+// CheckEgressScope checks a host of the egress tests (-6, -ds, the proxy), which
+// are not in hostMap. The system resolver of the DNS egress test is exempt, it
+// is the local infrastructure. Out of the scope it aborts, or returns false with -S
+func CheckEgressScope(host string, test string) bool {
+    if targetScope == nil || targetScope.AllowHost(host) {
+        return true
+    }
+    log.Printf("# out of scope: %s (%s)\n", host, test)
+    if !skipScope {
+        ErrPrint(fmt.Sprintf("Refuse to test the out-of-scope host %s (-S to skip it and continue)", host))
+    }
+    return false
+}
+
+func (s *Scope) outOfScope(hosts HostSet, i int) bool {
+    if ipSet, ok := hosts.(IPSet); ok {
+        addr := ipSet.Addr(i)
+        if s.addrs.ContainsAddr(addr) {
+            return false
+        }
+        s.refused.addAddr(addr)
+        return true
+    }
+    host := hosts.Host(i)
+    if s.AllowHost(host) {
+        return false
+    }
+    s.refused.names[host] = true
+    return true
+}
+
+// EnforceScope removes the out-of-scope hosts from hostMap, the refusal list goes
+// to the log and the run is aborted unless skipScope is set
+func EnforceScope(s *Scope) int {
+    refused := RemoveHosts(s.outOfScope)
+    if refused == 0 {
+        return 0
+    }
+    s.refused.merge()
+    for _, r := range s.refused.ranges {
+        if r.start == r.end {
+            log.Printf("# out of scope: %s\n", Uint32ToIP(r.start))
+        } else {
+            log.Printf("# out of scope: %s - %s\n", Uint32ToIP(r.start), Uint32ToIP(r.end))
+        }
+    }
+    for name := range s.refused.names {
+        log.Printf("# out of scope: %s\n", name)
+    }
+    if !skipScope {
+        ErrPrint(fmt.Sprintf("Refuse to scan %d out-of-scope hosts (-S to skip them and continue)", refused))
+    }
+    return refused
+}
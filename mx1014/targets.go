@@ -0,0 +1,402 @@
+package mx1014
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// HostSet is a lazily expanded target, the hosts are produced on demand by index
+// so that a huge range (e.g. 10.0.0.0/8) costs no memory before dispatch
+type HostSet interface {
+    Len() int
+    Host(i int) string
+}
+
+// IPSet is a HostSet of IPv4 addresses
+type IPSet interface {
+    HostSet
+    Addr(i int) uint32
+}
+
+func IPToUint32(ip net.IP) uint32 {
+    ip4 := ip.To4()
+    return uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+}
+
+func Uint32ToIP(addr uint32) string {
+    return strconv.Itoa(int(addr>>24)) + "." + strconv.Itoa(int(addr>>16&0xff)) + "." +
+        strconv.Itoa(int(addr>>8&0xff)) + "." + strconv.Itoa(int(addr&0xff))
+}
+
+// ipRange: start, start+1, ..., start+size-1
+type ipRange struct {
+    start uint32
+    size  int
+}
+
+func (r *ipRange) Len() int {
+    return r.size
+}
+
+func (r *ipRange) Addr(i int) uint32 {
+    return r.start + uint32(i)
+}
+
+func (r *ipRange) Host(i int) string {
+    return Uint32ToIP(r.Addr(i))
+}
+
+// ipBlocks: the cartesian product of the four octet lists, the last octet changes fastest
+type ipBlocks struct {
+    blocks [4][]uint8
+    size   int
+}
+
+func (b *ipBlocks) Len() int {
+    return b.size
+}
+
+func (b *ipBlocks) Addr(i int) uint32 {
+    var addr uint32
+    for j := 3; j >= 0; j-- {
+        block := b.blocks[j]
+        addr |= uint32(block[i%len(block)]) << uint(8*(3-j))
+        i /= len(block)
+    }
+    return addr
+}
+
+func (b *ipBlocks) Host(i int) string {
+    return Uint32ToIP(b.Addr(i))
+}
+
+// hostName: a single host that is resolved when connecting
+type hostName string
+
+func (h hostName) Len() int {
+    return 1
+}
+
+func (h hostName) Host(i int) string {
+    return string(h)
+}
+
+func IPCIDR(cidr string) (HostSet, error) {
+    ip, ipnet, err := net.ParseCIDR(cidr)
+    if err != nil {
+        return nil, err
+    }
+    if ip.To4() == nil {
+        return nil, errors.New("only IPv4 CIDR is supported: " + cidr)
+    }
+    ones, bits := ipnet.Mask.Size()
+    r := &ipRange{start: IPToUint32(ipnet.IP), size: 1 << uint(bits-ones)}
+
+    // ignore the network address and the broadcast address
+    if r.size > 2 {
+        r.start++
+        r.size -= 2
+    }
+
+    return r, nil
+}
+
+func parseOctet(item string) (int, error) {
+    n, err := strconv.Atoi(item)
+    if err != nil {
+        return 0, fmt.Errorf("%q is not a number", item)
+    }
+    if n < 0 || n > 255 {
+        return 0, fmt.Errorf("%d is out of range 0-255", n)
+    }
+    return n, nil
+}
+
+// parseOctetBlock parses one octet: "*", "n", "a-b" or a comma list of them
+func parseOctetBlock(item string) ([]uint8, error) {
+    var block []uint8
+    seen := make(map[int]bool)
+    add := func(j int) {
+        if !seen[j] {
+            seen[j] = true
+            block = append(block, uint8(j))
+        }
+    }
+    for _, part := range strings.Split(item, ",") {
+        if part == "*" {
+            for j := 0; j < 256; j++ {
+                add(j)
+            }
+        } else if strings.ContainsAny(part, "-") {
+            a := strings.Split(part, "-")
+            if len(a) != 2 {
+                return nil, fmt.Errorf("wrong range %q", part)
+            }
+            Start, err := parseOctet(a[0])
+            if err != nil {
+                return nil, err
+            }
+            End, err := parseOctet(a[1])
+            if err != nil {
+                return nil, err
+            }
+            if Start >= End {
+                return nil, fmt.Errorf("wrong range %q, start must be less than end", part)
+            }
+            for j := Start; j <= End; j++ {
+                add(j)
+            }
+        } else {
+            j, err := parseOctet(part)
+            if err != nil {
+                return nil, err
+            }
+            add(j)
+        }
+    }
+    return block, nil
+}
+
+// IPWildcard: every octet is "*", "n", "a-b" or a comma list of them, e.g. 192.168.1,3.1-10
+func IPWildcard(target string) (HostSet, error) {
+    items := strings.Split(target, ".")
+    if len(items) != 4 {
+        return nil, fmt.Errorf("%q has %d octets, expect 4", target, len(items))
+    }
+    b := &ipBlocks{size: 1}
+    for i := 0; i <= 3; i++ {
+        block, err := parseOctetBlock(items[i])
+        if err != nil {
+            return nil, fmt.Errorf("octet %d of %q: %s", i+1, target, err)
+        }
+        b.blocks[i] = block
+        b.size *= len(block)
+    }
+    return b, nil
+}
+
+// IPFullRange: a range of full addresses, e.g. 10.0.0.5-10.0.1.20
+func IPFullRange(target string) (HostSet, error) {
+    items := strings.Split(target, "-")
+    if len(items) != 2 {
+        return nil, fmt.Errorf("wrong address range %q", target)
+    }
+    var addrs [2]uint32
+    for i, item := range items {
+        ip := net.ParseIP(item)
+        if ip == nil || ip.To4() == nil {
+            return nil, fmt.Errorf("%q of range %q is not an IPv4 address", item, target)
+        }
+        addrs[i] = IPToUint32(ip)
+    }
+    if addrs[0] > addrs[1] {
+        return nil, fmt.Errorf("wrong address range %q, start must not be greater than end", target)
+    }
+    return &ipRange{start: addrs[0], size: int(addrs[1]-addrs[0]) + 1}, nil
+}
+
+// braceSet: hostnames with brace expansion, e.g. web{01..20}.corp.local, {db,app}1.local
+type braceSet struct {
+    parts [][]string // literal parts have a single choice
+    size  int
+}
+
+func (b *braceSet) Len() int {
+    return b.size
+}
+
+func (b *braceSet) Host(i int) string {
+    items := make([]string, len(b.parts))
+    for j := len(b.parts) - 1; j >= 0; j-- {
+        part := b.parts[j]
+        items[j] = part[i%len(part)]
+        i /= len(part)
+    }
+    return strings.Join(items, "")
+}
+
+func parseBrace(item string) ([]string, error) {
+    if strings.Contains(item, "..") {
+        a := strings.Split(item, "..")
+        if len(a) != 2 {
+            return nil, fmt.Errorf("wrong brace range {%s}", item)
+        }
+        Start, err := strconv.Atoi(a[0])
+        if err != nil {
+            return nil, fmt.Errorf("%q of {%s} is not a number", a[0], item)
+        }
+        End, err := strconv.Atoi(a[1])
+        if err != nil {
+            return nil, fmt.Errorf("%q of {%s} is not a number", a[1], item)
+        }
+        if Start > End {
+            return nil, fmt.Errorf("wrong brace range {%s}, start must not be greater than end", item)
+        }
+        // {01..20} keeps the zero padding
+        width := 0
+        if (len(a[0]) > 1 && a[0][0] == '0') || (len(a[1]) > 1 && a[1][0] == '0') {
+            width = len(a[0])
+            if len(a[1]) > width {
+                width = len(a[1])
+            }
+        }
+        var choices []string
+        for j := Start; j <= End; j++ {
+            choices = append(choices, fmt.Sprintf("%0*d", width, j))
+        }
+        return choices, nil
+    }
+    return strings.Split(item, ","), nil
+}
+
+func BraceExpand(target string) (HostSet, error) {
+    b := &braceSet{size: 1}
+    for target != "" {
+        start := strings.Index(target, "{")
+        if start < 0 {
+            b.parts = append(b.parts, []string{target})
+            break
+        }
+        end := strings.Index(target[start:], "}")
+        if end < 0 {
+            return nil, fmt.Errorf("unclosed brace in %q", target)
+        }
+        end += start
+        if start > 0 {
+            b.parts = append(b.parts, []string{target[:start]})
+        }
+        choices, err := parseBrace(target[start+1 : end])
+        if err != nil {
+            return nil, err
+        }
+        b.parts = append(b.parts, choices)
+        b.size *= len(choices)
+        target = target[end+1:]
+    }
+    return b, nil
+}
+
+func isAddrPattern(str string) bool {
+    return str != "" && strings.Trim(str, "0123456789.*-,") == ""
+}
+
+// isDottedPattern: four labels that start and end with address patterns, e.g. 10.0.1-x.1
+func isDottedPattern(target string) bool {
+    items := strings.Split(target, ".")
+    return len(items) == 4 && isAddrPattern(items[0]) && isAddrPattern(items[3])
+}
+
+// SplitTargets splits a comma separated target list, and keeps the commas of
+// the octet lists (192.168.1,3.1), the port lists (host:22,80) and the braces
+func SplitTargets(list string) []string {
+    var targets []string
+    current := ""
+    for _, piece := range strings.Split(list, ",") {
+        depth := strings.Count(current, "{") - strings.Count(current, "}")
+        if current == "" {
+            current = piece
+        } else if depth > 0 ||
+            (strings.Contains(current, ":") && !strings.ContainsAny(piece, ".{")) ||
+            (isAddrPattern(current) && (strings.Count(current, ".") < 3 || !strings.Contains(piece, "."))) {
+            current += "," + piece
+        } else {
+            targets = append(targets, current)
+            current = piece
+        }
+    }
+    if current != "" {
+        targets = append(targets, current)
+    }
+    return targets
+}
+
+// ParseHosts expands the host part of a target: CIDR, wildcard, range, braces or hostname,
+// the hostname must resolve
+func ParseHosts(target string) (HostSet, error) {
+    hosts, err := ExpandHosts(target)
+    if err != nil {
+        return nil, err
+    }
+    switch hosts.(type) {
+    case hostName:
+        if _, err := net.LookupHost(target); err != nil {
+            return nil, err
+        }
+    case *braceSet:
+        return resolveHosts(hosts)
+    }
+    return hosts, nil
+}
+
+// hostList: the hostnames of a brace set that resolve
+type hostList []string
+
+func (l hostList) Len() int {
+    return len(l)
+}
+
+func (l hostList) Host(i int) string {
+    return l[i]
+}
+
+// resolveHosts checks the expanded hostnames like a single hostname, the ones
+// that do not resolve are errors, or are skipped with -I
+func resolveHosts(hosts HostSet) (HostSet, error) {
+    errs := make([]error, hosts.Len())
+    wg := sync.WaitGroup{}
+    indexChan := make(chan int)
+    for i := 0; i < 32; i++ {
+        go func() {
+            for j := range indexChan {
+                _, errs[j] = net.LookupHost(hosts.Host(j))
+                wg.Done()
+            }
+        }()
+    }
+    for j := 0; j < hosts.Len(); j++ {
+        wg.Add(1)
+        indexChan <- j
+    }
+    wg.Wait()
+    close(indexChan)
+
+    var resolved hostList
+    for j, err := range errs {
+        if err == nil {
+            resolved = append(resolved, hosts.Host(j))
+        } else if ignoreErrHost {
+            log.Printf("# Wrong target: %s (%s)", hosts.Host(j), err)
+        } else {
+            return nil, err
+        }
+    }
+    if len(resolved) == hosts.Len() {
+        return hosts, nil
+    }
+    return resolved, nil
+}
+
+// ExpandHosts is ParseHosts without resolving the hostnames
+func ExpandHosts(target string) (HostSet, error) {
+    if strings.ContainsAny(target, "/") {
+        return IPCIDR(target)
+    } else if strings.ContainsAny(target, "{") {
+        return BraceExpand(target)
+    } else if strings.Count(target, ".") == 6 && strings.Count(target, "-") == 1 {
+        // 10.0.0.5-10.0.1.20, or a hostname such as a-b.c.d.e.f.g.com
+        if hosts, err := IPFullRange(target); err == nil {
+            return hosts, nil
+        }
+        if strings.Trim(target, "0123456789.-") == "" {
+            return IPFullRange(target)
+        }
+    } else if IsIP(target) || isDottedPattern(target) {
+        return IPWildcard(target)
+    }
+    return hostName(target), nil
+}
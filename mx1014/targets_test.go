@@ -0,0 +1,126 @@
+package mx1014
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestSplitTargets(t *testing.T) {
+    tests := []struct {
+        list    string
+        targets []string
+    }{
+        {"10.0.0.1", []string{"10.0.0.1"}},
+        {"10.0.0.1,10.0.0.2", []string{"10.0.0.1", "10.0.0.2"}},
+        {"192.168.1,3.1", []string{"192.168.1,3.1"}},
+        {"192.168.1.1,3,10.0.0.1", []string{"192.168.1.1,3", "10.0.0.1"}},
+        {"10.0.0.0/24,10.0.1.5-10.0.1.9", []string{"10.0.0.0/24", "10.0.1.5-10.0.1.9"}},
+        {"10.0.1.5-10.0.1.9,example.com", []string{"10.0.1.5-10.0.1.9", "example.com"}},
+        {"web{1,2}.local,10.0.0.0/30", []string{"web{1,2}.local", "10.0.0.0/30"}},
+        {"{db,app,web}{1..3}.local,example.com", []string{"{db,app,web}{1..3}.local", "example.com"}},
+        {"10.0.{1,2}.1,10.0.0.*", []string{"10.0.{1,2}.1", "10.0.0.*"}},
+        {"host:22,80,10.0.0.1:443", []string{"host:22,80", "10.0.0.1:443"}},
+        {"10.0.0.1:22,80,web{1,2}.local:8080", []string{"10.0.0.1:22,80", "web{1,2}.local:8080"}},
+        {"a.com,,b.com", []string{"a.com", "b.com"}},
+    }
+    for _, test := range tests {
+        if targets := SplitTargets(test.list); !reflect.DeepEqual(targets, test.targets) {
+            t.Errorf("SplitTargets(%q) = %q, expect %q", test.list, targets, test.targets)
+        }
+    }
+}
+
+func TestExpandHosts(t *testing.T) {
+    tests := []struct {
+        target string
+        size   int
+        first  string
+        last   string
+    }{
+        {"10.0.0.1", 1, "10.0.0.1", "10.0.0.1"},
+        {"10.0.0.0/30", 2, "10.0.0.1", "10.0.0.2"},
+        {"10.0.0.0/31", 2, "10.0.0.0", "10.0.0.1"},
+        {"10.0.0.7/32", 1, "10.0.0.7", "10.0.0.7"},
+        {"10.0.0.0/8", 1<<24 - 2, "10.0.0.1", "10.255.255.254"},
+        {"10.0.0.5-10.0.0.9", 5, "10.0.0.5", "10.0.0.9"},
+        {"10.0.0.254-10.0.1.1", 4, "10.0.0.254", "10.0.1.1"},
+        {"10.0.0.*", 256, "10.0.0.0", "10.0.0.255"},
+        {"192.168.1,3.1-2", 4, "192.168.1.1", "192.168.3.2"},
+        {"10.0-1.*.1", 512, "10.0.0.1", "10.1.255.1"},
+        {"web{01..20}.corp.local", 20, "web01.corp.local", "web20.corp.local"},
+        {"{db,app}{1..3}.local", 6, "db1.local", "app3.local"},
+        {"10.0.{1..3}.1", 3, "10.0.1.1", "10.0.3.1"},
+        {"example.com", 1, "example.com", "example.com"},
+        {"a-b.c.d.e.f.g.com", 1, "a-b.c.d.e.f.g.com", "a-b.c.d.e.f.g.com"},
+    }
+    for _, test := range tests {
+        hosts, err := ExpandHosts(test.target)
+        if err != nil {
+            t.Errorf("ExpandHosts(%q) error: %v", test.target, err)
+            continue
+        }
+        if hosts.Len() != test.size {
+            t.Errorf("ExpandHosts(%q) has %d hosts, expect %d", test.target, hosts.Len(), test.size)
+            continue
+        }
+        if first, last := hosts.Host(0), hosts.Host(hosts.Len()-1); first != test.first || last != test.last {
+            t.Errorf("ExpandHosts(%q) = %s ... %s, expect %s ... %s", test.target, first, last, test.first, test.last)
+        }
+    }
+}
+
+func TestExpandHostsError(t *testing.T) {
+    targets := []string{
+        "10.0.0.0/33",
+        "10.0.0.1/-1",
+        "fe80::/64",
+        "10.0.0.256",
+        "10.0.0.9-10.0.0.5",
+        "10.0.0.1-10.0.300.1",
+        "10.0.0.5-1",
+        "10.0.0.1-2-3",
+        "10.0.a.1",
+        "web{1..3.local",
+        "web{a..3}.local",
+        "web{3..1}.local",
+        "web{1..2..3}.local",
+    }
+    for _, target := range targets {
+        if hosts, err := ExpandHosts(target); err == nil {
+            t.Errorf("ExpandHosts(%q) = %d hosts, expect an error", target, hosts.Len())
+        }
+    }
+}
+
+func TestBraceExpand(t *testing.T) {
+    tests := []struct {
+        target string
+        hosts  []string
+    }{
+        {"plain.local", []string{"plain.local"}},
+        {"web{1..3}", []string{"web1", "web2", "web3"}},
+        {"{a,b}{1,2}", []string{"a1", "a2", "b1", "b2"}},
+        {"x{08..10}.local", []string{"x08.local", "x09.local", "x10.local"}},
+        {"x{9..11}", []string{"x9", "x10", "x11"}},
+        {"{-1..1}", []string{"-1", "0", "1"}},
+        {"{only}.local", []string{"only.local"}},
+        {"{db,app}-{1..2}.{corp,lab}", []string{
+            "db-1.corp", "db-1.lab", "db-2.corp", "db-2.lab",
+            "app-1.corp", "app-1.lab", "app-2.corp", "app-2.lab",
+        }},
+    }
+    for _, test := range tests {
+        set, err := BraceExpand(test.target)
+        if err != nil {
+            t.Errorf("BraceExpand(%q) error: %v", test.target, err)
+            continue
+        }
+        var hosts []string
+        for i := 0; i < set.Len(); i++ {
+            hosts = append(hosts, set.Host(i))
+        }
+        if !reflect.DeepEqual(hosts, test.hosts) {
+            t.Errorf("BraceExpand(%q) = %q, expect %q", test.target, hosts, test.hosts)
+        }
+    }
+}
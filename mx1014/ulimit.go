@@ -0,0 +1,162 @@
+package mx1014
+
+import (
+    "io/ioutil"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// reservedFiles are the open files kept for the output, the listeners and the resolver
+const reservedFiles = 64
+
+// the wait before the retry of a probe that ran out of open files, or of
+// ephemeral ports which come back only when the TIME_WAIT sockets expire
+const (
+    fileBackoff = time.Millisecond * 50
+    portBackoff = time.Second
+)
+
+func throttleBackoff(flag PortState) time.Duration {
+    if flag == StateNoPort {
+        return portBackoff
+    }
+    return fileBackoff
+}
+
+// EphemeralPorts returns the local port range of the connects (linux)
+func EphemeralPorts() (int, int, bool) {
+    data, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+    if err != nil {
+        return 0, 0, false
+    }
+    fields := strings.Fields(string(data))
+    if len(fields) != 2 {
+        return 0, 0, false
+    }
+    low, err1 := strconv.Atoi(fields[0])
+    high, err2 := strconv.Atoi(fields[1])
+    if err1 != nil || err2 != nil || low > high {
+        return 0, 0, false
+    }
+    return low, high, true
+}
+
+// FitConcurrency lowers the concurrency to fit the open files limit, each probe
+// holds one socket
+func FitConcurrency(concurrency int, fileLimit uint64) int {
+    if fileLimit == 0 {
+        return concurrency
+    }
+    fit := 1
+    if fileLimit > reservedFiles+1 {
+        fit = int(fileLimit - reservedFiles)
+    }
+    if concurrency > fit {
+        return fit
+    }
+    return concurrency
+}
+
+// FileThrottle lowers the concurrency of the TCP connects when the open files
+// run out at runtime (EMFILE/ENFILE), the sockets of other processes or of
+// the system count too, or when the ephemeral ports run out (EADDRNOTAVAIL).
+// The failed probe is retried instead of aborting the scan, and the
+// concurrency grows back by one after a full round of successes. Until the
+// first failure it only counts the probes in flight, without the lock
+type FileThrottle struct {
+    inflight   int64 // atomic, written under the mutex once engaged (first, 64-bit aligned)
+    engaged    int32 // atomic, 1 after the first failure
+    mutex      sync.Mutex
+    cond       *sync.Cond
+    limit      int
+    maxLimit   int
+    successes  int
+    lowest     int
+    lastShrink time.Time
+}
+
+// fileThrottle is created by Run for the TCP scan
+var fileThrottle *FileThrottle
+
+func NewFileThrottle(maxLimit int) *FileThrottle {
+    t := &FileThrottle{
+        limit:    maxLimit,
+        maxLimit: maxLimit,
+        lowest:   maxLimit,
+    }
+    t.cond = sync.NewCond(&t.mutex)
+    return t
+}
+
+// Acquire waits for a slot of the current concurrency
+func (t *FileThrottle) Acquire() {
+    if atomic.LoadInt32(&t.engaged) == 0 {
+        atomic.AddInt64(&t.inflight, 1)
+        return
+    }
+    t.mutex.Lock()
+    for atomic.LoadInt64(&t.inflight) >= int64(t.limit) {
+        t.cond.Wait()
+    }
+    atomic.AddInt64(&t.inflight, 1)
+    t.mutex.Unlock()
+}
+
+// Release frees the slot, true if the probe ran out of open files (StateAbort)
+// or of ephemeral ports (StateNoPort) and should be retried after the backoff
+func (t *FileThrottle) Release(flag PortState) bool {
+    failed := flag == StateAbort || flag == StateNoPort
+    if !failed && atomic.LoadInt32(&t.engaged) == 0 {
+        atomic.AddInt64(&t.inflight, -1)
+        return false
+    }
+    t.mutex.Lock()
+    inflight := int(atomic.AddInt64(&t.inflight, -1))
+    if !failed {
+        grown := false
+        t.successes++
+        if t.successes >= t.limit && t.limit < t.maxLimit {
+            t.limit++
+            t.successes = 0
+            grown = true
+        }
+        t.mutex.Unlock()
+        t.cond.Signal()
+        if grown {
+            t.cond.Signal()
+        }
+        return false
+    }
+    atomic.StoreInt32(&t.engaged, 1)
+    t.successes = 0
+    // the probes in flight fail together, shrink once for them. At 1 the
+    // probe keeps backing off until the files or ports come back
+    if time.Since(t.lastShrink) > time.Millisecond*100 {
+        t.lastShrink = time.Now()
+        t.limit = inflight * 3 / 4
+        if t.limit < 1 {
+            t.limit = 1
+        }
+        if t.limit < t.lowest {
+            t.lowest = t.limit
+            if flag == StateNoPort {
+                logResult("# ephemeral ports exhausted (EADDRNOTAVAIL), concurrency lowered to %d\n", t.limit)
+            } else {
+                logResult("# too many open files, concurrency lowered to %d\n", t.limit)
+            }
+        }
+    }
+    t.mutex.Unlock()
+    t.cond.Signal()
+    return true
+}
+
+// Lowest returns the lowest concurrency of the run
+func (t *FileThrottle) Lowest() int {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    return t.lowest
+}
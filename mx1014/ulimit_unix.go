@@ -15,12 +15,28 @@ func SetUlimit() {
         fmt.Println("# Error Getting Rlimit ", err)
     }
     if rLimit.Cur < 99999 {
+        hardLimit := rLimit.Max
         rLimit.Max = 999999
         rLimit.Cur = 999999
 
         err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit)
+        if err != nil && hardLimit > 0 {
+            // not root, the soft limit can still be raised to the hard limit
+            rLimit.Max = hardLimit
+            rLimit.Cur = hardLimit
+            err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit)
+        }
         if err != nil {
             fmt.Println("# Error Setting Rlimit ", err)
         }
     }
 }
+
+// FileLimit returns the effective open files limit, 0 if unknown
+func FileLimit() uint64 {
+    var rLimit syscall.Rlimit
+    if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
+        return 0
+    }
+    return uint64(rLimit.Cur)
+}
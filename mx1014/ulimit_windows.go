@@ -5,3 +5,8 @@ package mx1014
 
 func SetUlimit() {
 }
+
+// FileLimit returns the effective open files limit, 0 if unknown
+func FileLimit() uint64 {
+    return 0
+}
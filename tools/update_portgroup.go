@@ -0,0 +1,81 @@
+// +build ignore
+
+// Update portGroup and portGroupChildren of mx1014/mx1014.go from the "Port Group" of README.md
+//
+//   go run tools/update_portgroup.go
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "log"
+    "path/filepath"
+    "regexp"
+    "runtime"
+    "strconv"
+    "strings"
+
+    "../mx1014"
+)
+
+var (
+    portGroupRegexp         = regexp.MustCompile(`(?s)(portGroup = map\[string\]\[\]int \{\n)(.*?)(    \}\n)`)
+    portGroupChildrenRegexp = regexp.MustCompile(`(?s)(portGroupChildren = map\[string\]\[\]string \{\n)(.*?)(    \}\n)`)
+)
+
+func replaceBlock(gocode []byte, re *regexp.Regexp, lines []string) []byte {
+    if !re.Match(gocode) {
+        log.Fatalf("[!] %s not found in mx1014.go", re)
+    }
+    return re.ReplaceAllFunc(gocode, func(m []byte) []byte {
+        sub := re.FindSubmatch(m)
+        return []byte(string(sub[1]) + strings.Join(lines, "\n") + "\n" + string(sub[3]))
+    })
+}
+
+func main() {
+    _, file, _, _ := runtime.Caller(0)
+    projectRoot := filepath.Join(filepath.Dir(file), "..")
+    projectReadme := filepath.Join(projectRoot, "README.md")
+    mx1014GoFile := filepath.Join(projectRoot, "mx1014", "mx1014.go")
+
+    readme, err := ioutil.ReadFile(projectReadme)
+    if err != nil {
+        log.Fatalf("[!] %s", err)
+    }
+    defs, err := mx1014.ParsePortGroupDefs(readme)
+    if err != nil {
+        log.Fatalf("[!] portGroup not found: %s", err)
+    }
+    groups, err := mx1014.ResolvePortGroups(defs, nil)
+    if err != nil {
+        log.Fatalf("[!] %s", err)
+    }
+
+    var lines []string
+    for _, name := range defs.Names {
+        var ports []string
+        for _, port := range groups[name] {
+            ports = append(ports, strconv.Itoa(port))
+        }
+        lines = append(lines, fmt.Sprintf(`      "%s": []int{ %s },`, name, strings.Join(ports, ",")))
+    }
+
+    children := defs.Children()
+    var childrenLines []string
+    for _, name := range defs.Names {
+        if len(children[name]) > 0 {
+            childrenLines = append(childrenLines, fmt.Sprintf(`      "%s": []string{ "%s" },`, name, strings.Join(children[name], `","`)))
+        }
+    }
+
+    gocode, err := ioutil.ReadFile(mx1014GoFile)
+    if err != nil {
+        log.Fatalf("[!] %s", err)
+    }
+    gocode = replaceBlock(gocode, portGroupRegexp, lines)
+    gocode = replaceBlock(gocode, portGroupChildrenRegexp, childrenLines)
+    if err := ioutil.WriteFile(mx1014GoFile, gocode, 0644); err != nil {
+        log.Fatalf("[!] %s", err)
+    }
+}
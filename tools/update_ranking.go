@@ -0,0 +1,93 @@
+// +build ignore
+
+// Update nmapTopPorts of mx1014/ranking.go from nmap-services, the top 1000 TCP
+// ports ordered by the open frequency
+//
+//   go run tools/update_ranking.go /usr/share/nmap/nmap-services
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "regexp"
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+const topCount = 1000
+
+var nmapTopPortsRegexp = regexp.MustCompile(`(?s)// the top \d+ TCP ports of nmap-services.*?var nmapTopPorts = \[\]int\{\n.*?\n\}\n`)
+
+func main() {
+    servicesFile := "/usr/share/nmap/nmap-services"
+    if len(os.Args) > 1 {
+        servicesFile = os.Args[1]
+    }
+    _, file, _, _ := runtime.Caller(0)
+    rankingGoFile := filepath.Join(filepath.Dir(file), "..", "mx1014", "ranking.go")
+
+    data, err := ioutil.ReadFile(servicesFile)
+    if err != nil {
+        log.Fatalf("[!] %s", err)
+    }
+    frequency := make(map[int]float64)
+    for _, line := range strings.Split(string(data), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 3 || strings.HasPrefix(fields[0], "#") || !strings.HasSuffix(fields[1], "/tcp") {
+            continue
+        }
+        port, err1 := strconv.Atoi(strings.TrimSuffix(fields[1], "/tcp"))
+        freq, err2 := strconv.ParseFloat(fields[2], 64)
+        if err1 != nil || err2 != nil {
+            continue
+        }
+        frequency[port] += freq
+    }
+    var ports []int
+    for port := range frequency {
+        ports = append(ports, port)
+    }
+    sort.Slice(ports, func(i, j int) bool {
+        if frequency[ports[i]] != frequency[ports[j]] {
+            return frequency[ports[i]] > frequency[ports[j]]
+        }
+        return ports[i] < ports[j]
+    })
+    if len(ports) < topCount {
+        log.Fatalf("[!] only %d TCP ports in %s", len(ports), servicesFile)
+    }
+    ports = ports[:topCount]
+
+    var lines []string
+    for i := 0; i < len(ports); i += 20 {
+        end := i + 20
+        if end > len(ports) {
+            end = len(ports)
+        }
+        var items []string
+        for _, port := range ports[i:end] {
+            items = append(items, strconv.Itoa(port))
+        }
+        lines = append(lines, "    "+strings.Join(items, ", ")+",")
+    }
+    block := fmt.Sprintf("// the top %d TCP ports of nmap-services, ordered by the open frequency.\n"+
+        "// Regenerate it from nmap-services: go run tools/update_ranking.go\n"+
+        "var nmapTopPorts = []int{\n%s\n}\n", topCount, strings.Join(lines, "\n"))
+
+    gocode, err := ioutil.ReadFile(rankingGoFile)
+    if err != nil {
+        log.Fatalf("[!] %s", err)
+    }
+    if !nmapTopPortsRegexp.Match(gocode) {
+        log.Fatalf("[!] nmapTopPorts not found in %s", rankingGoFile)
+    }
+    gocode = nmapTopPortsRegexp.ReplaceAllLiteral(gocode, []byte(block))
+    if err := ioutil.WriteFile(rankingGoFile, gocode, 0644); err != nil {
+        log.Fatalf("[!] %s", err)
+    }
+}